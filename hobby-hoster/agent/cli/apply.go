@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/spf13/cobra"
+)
+
+type DesiredProject struct {
+	Repo string `json:"repo,omitempty"`
+	// Compose is a docker-compose.yml deployed as is instead of cloning Repo, for projects that only run published images
+	Compose            string   `json:"compose,omitempty"`
+	Subdomain          string   `json:"subdomain"`
+	Branch             string   `json:"branch,omitempty"`
+	ExtraTraefikLabels []string `json:"extra_traefik_labels,omitempty"`
+	// DriftPolicy is what the reconciler does when the project drifts from the desired state: "report" (default) or "repair"
+	DriftPolicy DriftPolicy `json:"drift_policy,omitempty"`
+	// PollInterval (e.g. "5m") makes the daemon poll the branch and redeploy when it moves, polling is off when empty
+	PollInterval string `json:"poll_interval,omitempty"`
+	// Commit is filled in by apply with the commit it deployed, it is what drift detection compares HEAD against
+	Commit string `json:"commit,omitempty"`
+}
+
+func (p DesiredProject) pollInterval() (time.Duration, error) {
+	if p.PollInterval == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(p.PollInterval)
+	if err == nil && interval < 0 {
+		err = errors.New("must not be negative")
+	}
+	return interval, err
+}
+
+// DesiredState is everything that should be running on the agent. Any service not listed is removed by apply.
+// config.json can be passed as is: its "domain_name" is used when "domain" is empty and unknown keys are ignored.
+type DesiredState struct {
+	Domain       string           `json:"domain"`
+	DomainName   string           `json:"domain_name,omitempty"`
+	Projects     []DesiredProject `json:"projects"`
+	ForceRebuild bool             `json:"force_rebuild,omitempty"`
+}
+
+func (s *DesiredState) normalize() error {
+	if s.Domain == "" {
+		s.Domain = s.DomainName
+	}
+	s.DomainName = ""
+	if s.Domain == "" {
+		return errors.New("'domain' is required")
+	}
+
+	seen := make(map[string]bool)
+	for _, project := range s.Projects {
+		if !isValidSubdomain(project.Subdomain) {
+			return fmt.Errorf("invalid subdomain: %q", project.Subdomain)
+		}
+		if seen[project.Subdomain] {
+			return fmt.Errorf("subdomain %s is listed more than once", project.Subdomain)
+		}
+		seen[project.Subdomain] = true
+		if (project.Repo == "") == (project.Compose == "") {
+			return fmt.Errorf("exactly one of 'repo' and 'compose' is required for subdomain %s", project.Subdomain)
+		}
+		if _, err := project.pollInterval(); err != nil {
+			return fmt.Errorf("invalid poll_interval %q for subdomain %s: %v", project.PollInterval, project.Subdomain, err)
+		}
+		if project.PollInterval != "" && project.Repo == "" {
+			return fmt.Errorf("poll_interval needs a 'repo' to poll for subdomain %s", project.Subdomain)
+		}
+		switch project.DriftPolicy {
+		case "", DriftPolicyReport, DriftPolicyRepair:
+		default:
+			return fmt.Errorf("invalid drift_policy %q for subdomain %s, expected %q or %q", project.DriftPolicy, project.Subdomain, DriftPolicyReport, DriftPolicyRepair)
+		}
+	}
+	return nil
+}
+
+type PlanAction string
+
+const (
+	PlanCreate PlanAction = "create"
+	PlanUpdate PlanAction = "update"
+	PlanDelete PlanAction = "delete"
+	PlanNoop   PlanAction = "no-op"
+)
+
+type PlanItem struct {
+	Subdomain     string     `json:"subdomain"`
+	Action        PlanAction `json:"action"`
+	Reason        string     `json:"reason"`
+	Repo          string     `json:"repo,omitempty"`
+	CurrentCommit string     `json:"current_commit,omitempty"`
+	DesiredCommit string     `json:"desired_commit,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	// Rollback is set when the deploy failed and the previous release was restored
+	Rollback *RollbackReport `json:"rollback,omitempty"`
+	// Warnings lists the hobby-hoster.* labels of a deployed project the agent doesn't know, see RebuildResult
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// getRemoteCommit returns the commit the branch (or the remote's HEAD when branch is empty) points to, like `git ls-remote`
+func getRemoteCommit(repo string, branch string) (string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{repo}})
+	refs, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote references of %s: %v", repo, err)
+	}
+
+	refsByName := make(map[plumbing.ReferenceName]*plumbing.Reference)
+	for _, ref := range refs {
+		refsByName[ref.Name()] = ref
+	}
+
+	name := plumbing.HEAD
+	if branch != "" {
+		name = plumbing.NewBranchReferenceName(branch)
+	}
+	// HEAD is usually advertised as a symbolic reference to the default branch
+	for i := 0; i < 5; i++ {
+		ref, ok := refsByName[name]
+		if !ok {
+			return "", fmt.Errorf("reference %s not found in %s", name, repo)
+		}
+		if ref.Type() == plumbing.HashReference {
+			return ref.Hash().String(), nil
+		}
+		name = ref.Target()
+	}
+	return "", fmt.Errorf("too many symbolic references resolving %s in %s", name, repo)
+}
+
+func computePlan(state DesiredState) ([]PlanItem, error) {
+	services, err := listServices()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]Service)
+	for _, service := range services {
+		current[service.Subdomain] = service
+	}
+
+	plan := []PlanItem{}
+	desired := make(map[string]bool)
+	for _, project := range state.Projects {
+		desired[project.Subdomain] = true
+		desiredCommit := getComposeRevision(project.Compose)
+		if project.Repo != "" {
+			desiredCommit, err = getRemoteCommit(project.Repo, project.Branch)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		item := PlanItem{Subdomain: project.Subdomain, Repo: project.Repo, DesiredCommit: desiredCommit}
+		service, exists := current[project.Subdomain]
+		switch {
+		case !exists:
+			item.Action = PlanCreate
+			item.Reason = "not deployed"
+		case service.LastCommit != desiredCommit:
+			item.Action = PlanUpdate
+			item.CurrentCommit = service.LastCommit
+			item.Reason = "commit changed"
+		case state.ForceRebuild:
+			item.Action = PlanUpdate
+			item.CurrentCommit = service.LastCommit
+			item.Reason = "forced rebuild"
+		default:
+			item.Action = PlanNoop
+			item.CurrentCommit = service.LastCommit
+			item.Reason = "up to date"
+		}
+		plan = append(plan, item)
+	}
+
+	var removed []string
+	for subdomain := range current {
+		if !desired[subdomain] {
+			removed = append(removed, subdomain)
+		}
+	}
+	sort.Strings(removed)
+	for _, subdomain := range removed {
+		plan = append(plan, PlanItem{
+			Subdomain:     subdomain,
+			Action:        PlanDelete,
+			Reason:        "not in desired state",
+			CurrentCommit: current[subdomain].LastCommit,
+		})
+	}
+
+	return plan, nil
+}
+
+// executePlan carries out the plan, recording failures on the plan items themselves.
+// Services are built before anything is removed, the same order deploy.py always used.
+func executePlan(state DesiredState, plan []PlanItem, out *OpOutput) []string {
+	projects := make(map[string]DesiredProject)
+	for _, project := range state.Projects {
+		projects[project.Subdomain] = project
+	}
+
+	var errs []string
+	for i := range plan {
+		item := &plan[i]
+		if item.Action != PlanCreate && item.Action != PlanUpdate {
+			continue
+		}
+		err := deployProject(state.Domain, projects[item.Subdomain], out)
+		// a project whose labels can't be read fails the deploy with the same error
+		item.Warnings, _ = getLabelWarnings(getProjectPath(item.Subdomain))
+		if err != nil {
+			item.Error = err.Error()
+			item.Rollback = rollbackReportOf(err)
+			errs = append(errs, fmt.Sprintf("Failed to %s service %s: %v", item.Action, item.Subdomain, err))
+		}
+	}
+
+	for i := range plan {
+		item := &plan[i]
+		if item.Action != PlanDelete {
+			continue
+		}
+		if err := removeService(item.Subdomain, out); err != nil {
+			item.Error = err.Error()
+			errs = append(errs, fmt.Sprintf("Failed to remove service %s: %v", item.Subdomain, err))
+		}
+	}
+
+	// the state is recorded even if some projects failed, it is still what should be running
+	commits := make(map[string]string)
+	for _, item := range plan {
+		commits[item.Subdomain] = item.DesiredCommit
+	}
+	for i := range state.Projects {
+		state.Projects[i].Commit = commits[state.Projects[i].Subdomain]
+	}
+	lock, err := lockDesiredState()
+	if err == nil {
+		err = saveDesiredState(state)
+		lock.Unlock()
+	}
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Failed to record desired state: %v", err))
+	}
+	return errs
+}
+
+// deployProject clones the project's branch (or writes its compose file) and rebuilds it, which is how every code path (apply, the reconciler, webhooks) deploys,
+// and rolls back to the previous release when either step fails.
+func deployProject(domain string, project DesiredProject, out *OpOutput) error {
+	return deployProjectAt(domain, project, "", out)
+}
+
+// deployProjectAt deploys the project like deployProject, but at the given commit instead of the branch head
+// when commit isn't empty. A compose file is only deployed if it still has that revision.
+func deployProjectAt(domain string, project DesiredProject, commit string, out *OpOutput) error {
+	if project.Repo == "" && commit != "" && getComposeRevision(project.Compose) != commit {
+		return fmt.Errorf("the compose file of %s no longer has revision %s", project.Subdomain, shortCommit(commit))
+	}
+	return withRollback(project.Subdomain, out, func() error {
+		var err error
+		if project.Repo == "" {
+			err = writeComposeProject(project.Subdomain, project.Compose, out)
+		} else {
+			err = cloneService(cloneTarget{Repo: project.Repo, Subdomain: project.Subdomain, Branch: project.Branch, Commit: commit}, out)
+		}
+		if err != nil {
+			return err
+		}
+		return rebuildProject(domain, project.Subdomain, project.ExtraTraefikLabels, out)
+	})
+}
+
+// applySubdomains returns the projects applying the state can change: the desired ones and the deployed ones it may remove
+func applySubdomains(state DesiredState) ([]string, error) {
+	var subdomains []string
+	for _, project := range state.Projects {
+		subdomains = append(subdomains, project.Subdomain)
+	}
+	files, err := os.ReadDir(ROOT_PROJECT_DIR)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() && isValidSubdomain(f.Name()) {
+			subdomains = append(subdomains, f.Name())
+		}
+	}
+	return subdomains, nil
+}
+
+func applyDesiredState(state DesiredState, dryRun bool, out *OpOutput) ([]PlanItem, []string) {
+	if err := state.normalize(); err != nil {
+		return nil, []string{err.Error()}
+	}
+	plan, err := computePlan(state)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	if dryRun {
+		return plan, nil
+	}
+	return plan, executePlan(state, plan, out)
+}
+
+func printPlan(plan []PlanItem) {
+	for _, item := range plan {
+		commits := ""
+		switch item.Action {
+		case PlanCreate:
+			commits = shortCommit(item.DesiredCommit)
+		case PlanUpdate:
+			commits = fmt.Sprintf("%s -> %s", shortCommit(item.CurrentCommit), shortCommit(item.DesiredCommit))
+		default:
+			commits = shortCommit(item.CurrentCommit)
+		}
+		fmt.Printf("%-7s %-20s %-20s %s\n", item.Action, item.Subdomain, commits, item.Reason)
+	}
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 8 {
+		return commit[:8]
+	}
+	return commit
+}
+
+var applyCmd = &cobra.Command{
+	Use:   `apply [desired-state-json | -]`,
+	Short: "Reconcile the agent with a desired state",
+	Long: `This command takes the full desired state ({"domain": "example.com", "projects": [{"repo": "...", "subdomain": "..."}]}, config.json works as is),
+prints a plan with a create, update, delete or no-op action per subdomain and then executes it. Pass - to read the desired state from stdin.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		force, _ := cmd.Flags().GetBool("force-rebuild")
+
+		printError := func(err error) error {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		raw := []byte(args[0])
+		if args[0] == "-" {
+			var err error
+			raw, err = io.ReadAll(os.Stdin)
+			if err != nil {
+				return printError(fmt.Errorf("failed to read desired state from stdin: %v", err))
+			}
+		}
+		var state DesiredState
+		if err := json.Unmarshal(raw, &state); err != nil {
+			return printError(fmt.Errorf("invalid desired state: %v", err))
+		}
+		state.ForceRebuild = state.ForceRebuild || force
+
+		if err := state.normalize(); err != nil {
+			return printError(err)
+		}
+		if async, _ := cmd.Flags().GetBool("async"); async && !dryRun {
+			return enqueueJobFromCLI(cmd, JobKindApply, state)
+		}
+
+		// the plan is computed under the locks, so nothing changes the projects between planning and executing it
+		if !dryRun {
+			subdomains, err := applySubdomains(state)
+			if err != nil {
+				return printError(err)
+			}
+			unlock, err := lockProjects(subdomains)
+			if err != nil {
+				return printError(err)
+			}
+			defer unlock()
+		}
+		plan, err := computePlan(state)
+		if err != nil {
+			return printError(err)
+		}
+		if !jsonOutput {
+			printPlan(plan)
+		}
+
+		var errs []string
+		if !dryRun {
+			errs = executePlan(state, plan, newCLIOutput(cmd))
+		}
+		if !jsonOutput {
+			for _, item := range plan {
+				for _, warning := range item.Warnings {
+					fmt.Printf("%-20s warning: %s\n", item.Subdomain, warning)
+				}
+			}
+		}
+
+		if jsonOutput {
+			resultJson, _ := json.Marshal(resultJSON(map[string]interface{}{"plan": plan}, errs))
+			fmt.Println(string(resultJson))
+			return nil
+		}
+		if len(errs) > 0 {
+			return errors.New(fmt.Sprintf("Encountered errors during apply: %v", strings.Join(errs, "; ")))
+		}
+		return nil
+	},
+}
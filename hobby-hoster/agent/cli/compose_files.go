@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the file names compose looks for in the project directory, in the order it prefers them
+var COMPOSE_FILE_NAMES = []string{"compose.yaml", "compose.yml", "docker-compose.yml", "docker-compose.yaml"}
+var COMPOSE_OVERRIDE_FILE_NAMES = []string{"compose.override.yml", "compose.override.yaml", "docker-compose.override.yml", "docker-compose.override.yaml"}
+
+// readDotEnv reads the .env file of the project the way compose does: KEY=VALUE lines, optionally quoted or
+// prefixed with export, and # comments. A project without a .env file has no variables.
+func readDotEnv(fullProjectDir string) (map[string]string, error) {
+	vars := make(map[string]string)
+	file, err := os.Open(filepath.Join(fullProjectDir, ".env"))
+	if os.IsNotExist(err) {
+		return vars, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !found {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		} else if comment := strings.Index(value, " #"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+		vars[key] = value
+	}
+	return vars, scanner.Err()
+}
+
+// getComposeFiles returns the compose files of the project, relative to its directory and in the order compose merges
+// them: the COMPOSE_FILE list of the project's .env, or else the first of COMPOSE_FILE_NAMES that exists followed by
+// the first of COMPOSE_OVERRIDE_FILE_NAMES, if any.
+func getComposeFiles(fullProjectDir string) ([]string, error) {
+	vars, err := readDotEnv(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+	if list := vars["COMPOSE_FILE"]; list != "" {
+		separator := vars["COMPOSE_PATH_SEPARATOR"]
+		if separator == "" {
+			separator = ":"
+		}
+		var files []string
+		for _, file := range strings.Split(list, separator) {
+			if file == "" {
+				continue
+			}
+			if filepath.IsAbs(file) || !filepath.IsLocal(file) {
+				return nil, fmt.Errorf("COMPOSE_FILE may only list files inside the project, not %s", file)
+			}
+			if _, err := os.Stat(filepath.Join(fullProjectDir, file)); err != nil {
+				return nil, fmt.Errorf("compose file %s listed in COMPOSE_FILE does not exist", file)
+			}
+			files = append(files, file)
+		}
+		return files, nil
+	}
+
+	var files []string
+	for _, names := range [][]string{COMPOSE_FILE_NAMES, COMPOSE_OVERRIDE_FILE_NAMES} {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(fullProjectDir, name)); err == nil {
+				files = append(files, name)
+				break
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no compose file (%s) in %s", strings.Join(COMPOSE_FILE_NAMES, ", "), fullProjectDir)
+		}
+	}
+	return files, nil
+}
+
+// loadComposeModel returns the project the way compose sees it: all of its compose files merged in order, with their
+// includes and extends resolved. Only the agent's own override is left out.
+func loadComposeModel(fullProjectDir string) (map[string]interface{}, error) {
+	files, err := getComposeFiles(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+	model := map[interface{}]interface{}{}
+	for _, file := range files {
+		loaded, err := loadComposeFileModel(filepath.Join(fullProjectDir, file), nil)
+		if err != nil {
+			return nil, err
+		}
+		model = mergeCompose("", model, loaded).(map[interface{}]interface{})
+	}
+	if _, ok := model["services"].(map[interface{}]interface{}); !ok {
+		return nil, fmt.Errorf("the compose files of the project (%s) have no 'services' section", strings.Join(files, ", "))
+	}
+	dockerCompose := make(map[string]interface{})
+	for key, value := range model {
+		dockerCompose[fmt.Sprint(key)] = value
+	}
+	return dockerCompose, nil
+}
+
+// loadComposeFileModel loads one compose file with the files it includes merged in. loading lists the files being
+// loaded, to catch includes and extends that go in circles.
+func loadComposeFileModel(path string, loading []string) (map[interface{}]interface{}, error) {
+	for _, file := range loading {
+		if file == path {
+			return nil, fmt.Errorf("%s includes or extends itself", filepath.Base(path))
+		}
+	}
+	loading = append(loading, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %v", filepath.Base(path), err)
+	}
+	if file == nil {
+		file = map[interface{}]interface{}{}
+	}
+
+	// included files come first, the including file is merged on top of them
+	model := map[interface{}]interface{}{}
+	includes, _ := file["include"].([]interface{})
+	for _, include := range includes {
+		var paths []interface{}
+		switch include := include.(type) {
+		case string:
+			paths = []interface{}{include}
+		case map[interface{}]interface{}:
+			switch path := include["path"].(type) {
+			case string:
+				paths = []interface{}{path}
+			case []interface{}:
+				paths = path
+			}
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("%s: invalid include %v", filepath.Base(path), include)
+		}
+		for _, includePath := range paths {
+			included, err := loadComposeFileModel(filepath.Join(filepath.Dir(path), fmt.Sprint(includePath)), loading)
+			if err != nil {
+				return nil, err
+			}
+			model = mergeCompose("", model, included).(map[interface{}]interface{})
+		}
+	}
+	delete(file, "include")
+	model = mergeCompose("", model, file).(map[interface{}]interface{})
+
+	if services, ok := model["services"].(map[interface{}]interface{}); ok {
+		for name := range services {
+			if err := resolveExtends(path, services, fmt.Sprint(name), loading, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return model, nil
+}
+
+// resolveExtends replaces the service with the service it extends merged with its own definition, resolving the
+// extended service first. extending lists the services being resolved in this file, to catch cycles.
+func resolveExtends(path string, services map[interface{}]interface{}, name string, loading []string, extending []string) error {
+	service, ok := services[name].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	extends, ok := service["extends"]
+	if !ok {
+		return nil
+	}
+	for _, other := range extending {
+		if other == name {
+			return fmt.Errorf("%s: service %s extends itself", filepath.Base(path), name)
+		}
+	}
+
+	var baseName, baseFile string
+	switch extends := extends.(type) {
+	case string:
+		baseName = extends
+	case map[interface{}]interface{}:
+		baseName = fmt.Sprint(extends["service"])
+		if file, ok := extends["file"].(string); ok {
+			baseFile = file
+		}
+	}
+
+	var base interface{}
+	if baseFile != "" {
+		other, err := loadComposeFileModel(filepath.Join(filepath.Dir(path), baseFile), loading)
+		if err != nil {
+			return err
+		}
+		otherServices, _ := other["services"].(map[interface{}]interface{})
+		base = otherServices[baseName]
+	} else {
+		if err := resolveExtends(path, services, baseName, loading, append(extending, name)); err != nil {
+			return err
+		}
+		base = services[baseName]
+	}
+	baseMap, ok := base.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("%s: service %s extends %s, which does not exist", filepath.Base(path), name, baseName)
+	}
+
+	own := make(map[interface{}]interface{})
+	for key, value := range service {
+		if key != "extends" {
+			own[key] = value
+		}
+	}
+	services[name] = mergeCompose("services."+name, baseMap, own)
+	return nil
+}
+
+// service keys whose list and mapping forms are the same thing, compose merges them by key
+var composeKeyValueKeys = map[string]bool{"labels": true, "environment": true, "annotations": true, "extra_hosts": true, "sysctls": true}
+
+// the keys of a service a later file replaces instead of merging, by their path below the service
+var composeReplacedKeys = map[string]bool{"command": true, "entrypoint": true, "healthcheck.test": true}
+
+// mergeCompose merges a value of a later compose file (or an extending service) into the one before it, following
+// compose's rules: mappings are merged, lists are appended to without duplicates, everything else is replaced.
+// path is where in the model the values are, e.g. services.web.ports. Neither value is modified.
+func mergeCompose(path string, base interface{}, override interface{}) interface{} {
+	key := path[strings.LastIndex(path, ".")+1:]
+	if strings.HasPrefix(path, "services.") && strings.Count(path, ".") == 2 {
+		if composeKeyValueKeys[key] {
+			return mergeKeyValues(base, override)
+		}
+		if key == "networks" {
+			// a service's networks are a list of names or a mapping of names to their settings
+			base, override = networksAsMapping(base, override)
+		}
+	}
+	// services.web.healthcheck.test is healthcheck.test
+	if parts := strings.SplitN(path, ".", 3); len(parts) == 3 && parts[0] == "services" && composeReplacedKeys[parts[2]] {
+		return copyCompose(override)
+	}
+
+	switch override := override.(type) {
+	case map[interface{}]interface{}:
+		baseMap, ok := base.(map[interface{}]interface{})
+		if !ok {
+			return copyCompose(override)
+		}
+		merged := copyCompose(baseMap).(map[interface{}]interface{})
+		for k, value := range override {
+			childPath := fmt.Sprint(k)
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			if existing, ok := merged[k]; ok {
+				merged[k] = mergeCompose(childPath, existing, value)
+			} else {
+				merged[k] = copyCompose(value)
+			}
+		}
+		return merged
+	case []interface{}:
+		baseList, ok := base.([]interface{})
+		if !ok {
+			return copyCompose(override)
+		}
+		merged := copyCompose(baseList).([]interface{})
+		seen := make(map[string]bool)
+		for _, value := range baseList {
+			seen[fmt.Sprint(value)] = true
+		}
+		for _, value := range override {
+			if !seen[fmt.Sprint(value)] {
+				seen[fmt.Sprint(value)] = true
+				merged = append(merged, copyCompose(value))
+			}
+		}
+		return merged
+	}
+	return override
+}
+
+// mergeKeyValues merges labels, environments and the like, which are lists of KEY=VALUE or mappings. The result is a
+// mapping when both are, otherwise a list in the order the keys first appeared.
+func mergeKeyValues(base interface{}, override interface{}) interface{} {
+	var keys []string
+	entries := make(map[string]string)
+	values := make(map[interface{}]interface{})
+	bothMappings := true
+	for _, value := range []interface{}{base, override} {
+		switch value := value.(type) {
+		case []interface{}:
+			bothMappings = false
+			for _, entry := range value {
+				key, _, _ := strings.Cut(fmt.Sprint(entry), "=")
+				if _, ok := entries[key]; !ok {
+					keys = append(keys, key)
+				}
+				entries[key] = fmt.Sprint(entry)
+			}
+		case map[interface{}]interface{}:
+			for key, val := range value {
+				if _, ok := entries[fmt.Sprint(key)]; !ok {
+					keys = append(keys, fmt.Sprint(key))
+				}
+				if val == nil {
+					entries[fmt.Sprint(key)] = fmt.Sprint(key)
+				} else {
+					entries[fmt.Sprint(key)] = fmt.Sprintf("%v=%v", key, val)
+				}
+				values[key] = val
+			}
+		}
+	}
+	if bothMappings {
+		return values
+	}
+	merged := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		merged = append(merged, entries[key])
+	}
+	return merged
+}
+
+// networksAsMapping turns a list of network names into a mapping when the other value is one
+func networksAsMapping(base interface{}, override interface{}) (interface{}, interface{}) {
+	_, baseIsMap := base.(map[interface{}]interface{})
+	_, overrideIsMap := override.(map[interface{}]interface{})
+	if baseIsMap == overrideIsMap {
+		return base, override
+	}
+	toMapping := func(value interface{}) interface{} {
+		list, ok := value.([]interface{})
+		if !ok {
+			return value
+		}
+		mapping := make(map[interface{}]interface{})
+		for _, name := range list {
+			mapping[name] = nil
+		}
+		return mapping
+	}
+	return toMapping(base), toMapping(override)
+}
+
+// copyCompose deep copies a value parsed from a compose file, so merged models don't share mutable parts
+func copyCompose(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		copied := make(map[interface{}]interface{}, len(value))
+		for k, v := range value {
+			copied[k] = copyCompose(v)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, v := range value {
+			copied[i] = copyCompose(v)
+		}
+		return copied
+	}
+	return value
+}
+
+// getComposeServices returns the services of the project's merged compose model
+func getComposeServices(fullProjectDir string) (map[interface{}]interface{}, error) {
+	dockerCompose, err := loadComposeModel(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+	return dockerCompose["services"].(map[interface{}]interface{}), nil
+}
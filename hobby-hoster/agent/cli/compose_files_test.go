@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMergeComposeReplacesOnlyServiceKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"docker-compose.yml": `services:
+  test:
+    image: app
+    command: ["serve", "--verbose"]
+    healthcheck:
+      test: ["CMD", "true"]
+      interval: 10s
+    environment:
+      A: "1"
+`,
+		"docker-compose.override.yml": `services:
+  test:
+    command: ["serve"]
+    healthcheck:
+      test: ["CMD", "false"]
+    environment:
+      B: "2"
+`,
+	})
+
+	services, err := getComposeServices(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a service named test is merged like any other, not replaced by the later file
+	service := services["test"].(map[interface{}]interface{})
+	if service["image"] != "app" {
+		t.Errorf("the service was replaced instead of merged: %v", service)
+	}
+	if command := service["command"]; !reflect.DeepEqual(command, []interface{}{"serve"}) {
+		t.Errorf("expected the command to be replaced, got %v", command)
+	}
+	healthcheck := service["healthcheck"].(map[interface{}]interface{})
+	if !reflect.DeepEqual(healthcheck["test"], []interface{}{"CMD", "false"}) || healthcheck["interval"] != "10s" {
+		t.Errorf("expected healthcheck.test to be replaced and the rest merged, got %v", healthcheck)
+	}
+	if environment := service["environment"].(map[interface{}]interface{}); len(environment) != 2 {
+		t.Errorf("expected the environments to be merged, got %v", environment)
+	}
+}
+
+func TestPortsAreInterpolatedFromDotEnv(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		".env": "PORT=8080\nTARGET=80\n",
+		"docker-compose.yml": `services:
+  web:
+    image: app
+    ports:
+      - "${PORT}:${TARGET}"
+      - target: ${TARGET:-81}
+        protocol: udp
+`,
+	})
+
+	services, err := getComposeServices(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := readDotEnv(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports, err := portsForServices(services, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("expected 2 ports, got %v", ports)
+	}
+	if mapping := ports[0].mapping; mapping.PublishedStart != 8080 || mapping.TargetStart != 80 {
+		t.Errorf("expected 8080:80, got %+v", mapping)
+	}
+	if mapping := ports[1].mapping; mapping.TargetStart != 80 || mapping.Protocol != "udp" {
+		t.Errorf("expected 80/udp, got %+v", mapping)
+	}
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ComposeProject identifies the compose project of a subdomain for a ComposeRunner
+type ComposeProject struct {
+	// Name is the compose project name, i.e. the value of the com.docker.compose.project label
+	Name      string
+	Dir       string
+	Subdomain string
+	Output    *OpOutput
+}
+
+func newComposeProject(subdomain string, out *OpOutput) ComposeProject {
+	return ComposeProject{
+		Name:      composeProjectName(subdomain),
+		Dir:       getProjectPath(subdomain),
+		Subdomain: subdomain,
+		Output:    out,
+	}
+}
+
+// composeProjectName mirrors how compose derives the project name from the directory name
+func composeProjectName(subdomain string) string {
+	return strings.ToLower(subdomain)
+}
+
+type ContainerState struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Service  string `json:"service"`
+	State    string `json:"state"`
+	Health   string `json:"health,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Image    string `json:"image"`
+}
+
+// ContainerInfo is the detailed state of a single container
+type ContainerInfo struct {
+	ContainerState
+	StartedAt    time.Time `json:"started_at"`
+	RestartCount int       `json:"restart_count"`
+	// HealthOutput is the output of the last run of the image's HEALTHCHECK
+	HealthOutput string `json:"health_output,omitempty"`
+	// Networks maps the networks the container is attached to to its IP address on them
+	Networks map[string]string `json:"networks"`
+	// Ports are the container ports published on the host
+	Ports []PublishedPort `json:"ports"`
+	// Routers are the Traefik routers the container's labels attach it to
+	Routers []TraefikRouter `json:"routers"`
+}
+
+type PublishedPort struct {
+	// ContainerPort includes the protocol, e.g. 80/tcp
+	ContainerPort string `json:"container_port"`
+	HostIP        string `json:"host_ip"`
+	HostPort      string `json:"host_port"`
+}
+
+type TraefikRouter struct {
+	Name string `json:"name"`
+	Rule string `json:"rule"`
+}
+
+// ComposeLifecycle changes what runs on the host: it builds, pulls, starts and removes the containers of a project
+// and manages images. Building, pulling, starting and scaling need compose's model of the project (its files, the
+// override and the .env), which the Docker Engine API doesn't have, so every runner does them with the docker compose
+// CLI, the Engine runner included.
+type ComposeLifecycle interface {
+	Down(project ComposeProject) error
+	Build(project ComposeProject) error
+	// Pull fetches the images of the project's services that aren't built from source, logging in to the registries
+	// the agent has credentials for
+	Pull(project ComposeProject) error
+	Up(project ComposeProject) error
+	// Scale runs replicas containers of service, creating new ones from the current images while leaving running ones as they are
+	Scale(project ComposeProject, service string, replicas int) error
+	// RemoveContainer stops and removes a single container of the project
+	RemoveContainer(project ComposeProject, id string) error
+	// TagImage points the image reference target at the image source refers to
+	TagImage(project ComposeProject, source string, target string) error
+	// RemoveImage removes an image reference, the image itself is deleted once nothing refers to it anymore
+	RemoveImage(project ComposeProject, image string) error
+	// PruneBuildCache removes build cache that isn't in use until at most keepBytes are left and returns the space it freed
+	PruneBuildCache(project ComposeProject, keepBytes int64) (int64, error)
+	// ComposeVersion returns the version of the Docker Compose that builds and starts projects, e.g. 2.24.6
+	ComposeVersion(project ComposeProject) (string, error)
+}
+
+// ComposeInspector reads the state of a project's containers and of the host's images without changing them
+type ComposeInspector interface {
+	Ps(project ComposeProject) ([]ContainerState, error)
+	InspectContainer(project ComposeProject, id string) (*ContainerInfo, error)
+	// ImageDigest returns the registry digest of an image (e.g. nginx@sha256:...), or its ID for images that were built locally
+	ImageDigest(project ComposeProject, image string) (string, error)
+	// ContainerLogs emits the logs of a container to project.Output as lines of the "logs" step, each starting with its
+	// timestamp, until they end or ctx is done. With opts.Follow they only end when the container stops.
+	ContainerLogs(ctx context.Context, project ComposeProject, id string, opts LogOptions) error
+	// Stats samples the resource usage of the project's running containers
+	Stats(project ComposeProject) ([]ContainerUsage, error)
+	// ListImages lists every image on the host, not only the project's
+	ListImages(project ComposeProject) ([]ImageInfo, error)
+	// ImagesInUse returns the IDs of the images any container on the host, running or not, was created from
+	ImagesInUse(project ComposeProject) (map[string]bool, error)
+}
+
+// ComposeRunner performs the container operations of a compose project.
+// The Docker Engine API implementation is used when the socket is reachable and the docker compose CLI otherwise,
+// anything else (e.g. a fake for exercising the rebuild flow without Docker) can be swapped in through composeRunner.
+// Code that only looks at containers and images takes a ComposeInspector instead.
+type ComposeRunner interface {
+	ComposeLifecycle
+	ComposeInspector
+}
+
+// ComposeError is returned by runners when an operation on a project fails
+type ComposeError struct {
+	Op      string
+	Project string
+	Err     error
+	// Output is what the command printed, if the operation ran a command
+	Output string
+}
+
+func (e *ComposeError) Error() string {
+	if e.Output != "" {
+		return fmt.Sprintf("docker compose %s of project %s failed: %v, output: %s", e.Op, e.Project, e.Err, e.Output)
+	}
+	return fmt.Sprintf("docker compose %s of project %s failed: %v", e.Op, e.Project, e.Err)
+}
+
+func (e *ComposeError) Unwrap() error {
+	return e.Err
+}
+
+var DOCKER_BACKEND = "auto"
+var DOCKER_SOCKET = "/var/run/docker.sock"
+
+var composeRunner ComposeRunner
+var composeRunnerOnce sync.Once
+
+// getComposeRunner picks the runner once per process according to DOCKER_BACKEND (auto, engine or cli)
+func getComposeRunner() ComposeRunner {
+	composeRunnerOnce.Do(func() {
+		if composeRunner != nil {
+			return
+		}
+		cli := &composeCLIRunner{}
+		switch DOCKER_BACKEND {
+		case "cli":
+			composeRunner = cli
+		case "engine":
+			composeRunner = newDockerEngineRunner(newDockerClient(DOCKER_SOCKET), cli)
+		default:
+			client := newDockerClient(DOCKER_SOCKET)
+			// no socket access is an expected setup in auto mode, so nothing is printed: deploy.py treats stderr output as a failure
+			if err := client.Ping(); err != nil {
+				composeRunner = cli
+			} else {
+				composeRunner = newDockerEngineRunner(client, cli)
+			}
+		}
+	})
+	return composeRunner
+}
+
+// composeCLIRunner shells out to `docker compose` in the project directory
+type composeCLIRunner struct{}
+
+func (r *composeCLIRunner) run(project ComposeProject, step string, args ...string) (*CmdWrap, error) {
+	composeArgs := []string{"compose"}
+	if files := composeFileArgs(project.Dir); files != nil {
+		// with explicit files compose would name the project after the directory of the first one or its name key
+		composeArgs = append(append(composeArgs, "--project-name", project.Name), files...)
+	}
+	cmd := NewCmdWrap(project.Dir, "docker", append(composeArgs, args...)...).RecordTo(project.Output, project.Subdomain, step)
+	cmd.Run()
+	if cmd.err != nil {
+		return cmd, &ComposeError{Op: step, Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stdout.String() + "\n" + cmd.stderr.String())}
+	}
+	return cmd, nil
+}
+
+func (r *composeCLIRunner) Down(project ComposeProject) error {
+	_, err := r.run(project, "down", "down")
+	return err
+}
+
+func (r *composeCLIRunner) Build(project ComposeProject) error {
+	_, err := r.run(project, "build", "build")
+	return err
+}
+
+func (r *composeCLIRunner) Pull(project ComposeProject) error {
+	if err := loginToRegistries(project); err != nil {
+		return err
+	}
+	_, err := r.run(project, "pull", "pull", "--ignore-buildable")
+	return err
+}
+
+func (r *composeCLIRunner) Up(project ComposeProject) error {
+	_, err := r.run(project, "up", "up", "--detach")
+	return err
+}
+
+func (r *composeCLIRunner) Scale(project ComposeProject, service string, replicas int) error {
+	_, err := r.run(project, "scale", "up", "--detach", "--no-deps", "--no-recreate", "--scale", fmt.Sprintf("%s=%d", service, replicas), service)
+	return err
+}
+
+func (r *composeCLIRunner) RemoveContainer(project ComposeProject, id string) error {
+	if err := r.docker(project, "remove-container", "stop", id); err != nil {
+		return err
+	}
+	return r.docker(project, "remove-container", "rm", id)
+}
+
+func (r *composeCLIRunner) TagImage(project ComposeProject, source string, target string) error {
+	return r.docker(project, "tag-image", "tag", source, target)
+}
+
+func (r *composeCLIRunner) ImageDigest(project ComposeProject, image string) (string, error) {
+	cmd := NewCmdWrap(project.Dir, "docker", "image", "inspect", image)
+	cmd.Run()
+	if cmd.err != nil {
+		return "", &ComposeError{Op: "image inspect", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stderr.String())}
+	}
+	var inspects []dockerImageInspect
+	if err := json.Unmarshal(cmd.stdout.Bytes(), &inspects); err != nil || len(inspects) != 1 {
+		return "", &ComposeError{Op: "image inspect", Project: project.Name, Err: fmt.Errorf("failed to parse output: %v", err)}
+	}
+	return inspects[0].digest(image), nil
+}
+
+func (r *composeCLIRunner) ComposeVersion(project ComposeProject) (string, error) {
+	cmd := NewCmdWrap(project.Dir, "docker", "compose", "version", "--short")
+	cmd.Run()
+	if cmd.err != nil {
+		return "", &ComposeError{Op: "version", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stderr.String())}
+	}
+	return strings.TrimSpace(cmd.stdout.String()), nil
+}
+
+func (r *composeCLIRunner) RemoveImage(project ComposeProject, image string) error {
+	return r.docker(project, "remove-image", "image", "rm", image)
+}
+
+func (r *composeCLIRunner) InspectContainer(project ComposeProject, id string) (*ContainerInfo, error) {
+	cmd := NewCmdWrap(project.Dir, "docker", "inspect", "--type", "container", id).RecordTo(project.Output, project.Subdomain, "inspect")
+	cmd.Run()
+	if cmd.err != nil {
+		return nil, &ComposeError{Op: "inspect", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stdout.String() + "\n" + cmd.stderr.String())}
+	}
+	// docker inspect prints the same document the Engine API returns, wrapped in an array
+	var inspects []dockerContainerInspect
+	if err := json.Unmarshal(cmd.stdout.Bytes(), &inspects); err != nil || len(inspects) != 1 {
+		return nil, &ComposeError{Op: "inspect", Project: project.Name, Err: fmt.Errorf("failed to parse output: %v", err)}
+	}
+	return inspects[0].info(), nil
+}
+
+func (r *composeCLIRunner) ContainerLogs(ctx context.Context, project ComposeProject, id string, opts LogOptions) error {
+	args := []string{"logs", "--timestamps"}
+	if opts.Follow {
+		args = append(args, "--follow")
+	}
+	if !opts.Since.IsZero() {
+		args = append(args, "--since", opts.Since.Format(time.RFC3339Nano))
+	}
+	if opts.Tail >= 0 {
+		args = append(args, "--tail", strconv.Itoa(opts.Tail))
+	}
+	// not a CmdWrap, which keeps all output in memory: followed logs can run for days
+	cmd := exec.CommandContext(ctx, "docker", append(args, id)...)
+	cmd.Dir = project.Dir
+	stdout := newLineWriter(project.Output, project.Subdomain, "logs", "stdout")
+	stderr := newLineWriter(project.Output, project.Subdomain, "logs", "stderr")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return &ComposeError{Op: "logs", Project: project.Name, Err: err}
+	}
+	return nil
+}
+
+func (r *composeCLIRunner) Stats(project ComposeProject) ([]ContainerUsage, error) {
+	containers, err := r.Ps(project)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"stats", "--no-stream", "--no-trunc", "--format", "{{json .}}"}
+	running := []ContainerState{}
+	for _, container := range containers {
+		if container.State == "running" {
+			running = append(running, container)
+			args = append(args, container.ID)
+		}
+	}
+	if len(running) == 0 {
+		return []ContainerUsage{}, nil
+	}
+	cmd := NewCmdWrap(project.Dir, "docker", args...).RecordTo(project.Output, project.Subdomain, "stats")
+	cmd.Run()
+	if cmd.err != nil {
+		return nil, &ComposeError{Op: "stats", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stderr.String())}
+	}
+
+	// the sizes are formatted for humans, e.g. {"ID": "...", "CPUPerc": "0.52%", "MemUsage": "12.5MiB / 1GiB", "NetIO": "1.2kB / 648B"}
+	type statsEntry struct {
+		ID       string `json:"ID"`
+		Name     string `json:"Name"`
+		CPUPerc  string `json:"CPUPerc"`
+		MemUsage string `json:"MemUsage"`
+		NetIO    string `json:"NetIO"`
+		BlockIO  string `json:"BlockIO"`
+	}
+	usages := []ContainerUsage{}
+	for _, line := range strings.Split(strings.TrimSpace(cmd.stdout.String()), "\n") {
+		var entry statsEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, &ComposeError{Op: "stats", Project: project.Name, Err: fmt.Errorf("failed to parse output: %v", err)}
+		}
+		usage := ContainerUsage{ID: entry.ID, Name: entry.Name}
+		for _, container := range running {
+			// compose may print shortened IDs
+			if strings.HasPrefix(entry.ID, container.ID) || strings.HasPrefix(container.ID, entry.ID) {
+				usage.Service = container.Service
+			}
+		}
+		usage.CPUPercent, _ = strconv.ParseFloat(strings.TrimSuffix(entry.CPUPerc, "%"), 64)
+		usage.MemoryBytes, _ = parseDockerSizePair(entry.MemUsage)
+		usage.NetRxBytes, usage.NetTxBytes = parseDockerSizePair(entry.NetIO)
+		usage.BlockReadBytes, usage.BlockWriteBytes = parseDockerSizePair(entry.BlockIO)
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+func (r *composeCLIRunner) ListImages(project ComposeProject) ([]ImageInfo, error) {
+	cmd := NewCmdWrap(project.Dir, "docker", "image", "ls", "--quiet", "--no-trunc")
+	cmd.Run()
+	if cmd.err != nil {
+		return nil, &ComposeError{Op: "image ls", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stderr.String())}
+	}
+	// an image with several tags is listed once per tag
+	args := []string{"image", "inspect"}
+	seen := make(map[string]bool)
+	for _, id := range strings.Fields(cmd.stdout.String()) {
+		if !seen[id] {
+			seen[id] = true
+			args = append(args, id)
+		}
+	}
+	images := []ImageInfo{}
+	if len(seen) == 0 {
+		return images, nil
+	}
+	cmd = NewCmdWrap(project.Dir, "docker", args...)
+	cmd.Run()
+	if cmd.err != nil {
+		return nil, &ComposeError{Op: "image inspect", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stderr.String())}
+	}
+	var inspects []dockerImageInspect
+	if err := json.Unmarshal(cmd.stdout.Bytes(), &inspects); err != nil {
+		return nil, &ComposeError{Op: "image inspect", Project: project.Name, Err: fmt.Errorf("failed to parse output: %v", err)}
+	}
+	for _, inspect := range inspects {
+		images = append(images, inspect.info())
+	}
+	return images, nil
+}
+
+func (r *composeCLIRunner) ImagesInUse(project ComposeProject) (map[string]bool, error) {
+	cmd := NewCmdWrap(project.Dir, "docker", "ps", "--all", "--quiet", "--no-trunc")
+	cmd.Run()
+	if cmd.err != nil {
+		return nil, &ComposeError{Op: "ps", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stderr.String())}
+	}
+	inUse := make(map[string]bool)
+	ids := strings.Fields(cmd.stdout.String())
+	if len(ids) == 0 {
+		return inUse, nil
+	}
+	cmd = NewCmdWrap(project.Dir, "docker", append([]string{"inspect", "--type", "container", "--format", "{{.Image}}"}, ids...)...)
+	cmd.Run()
+	if cmd.err != nil {
+		return nil, &ComposeError{Op: "inspect", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stderr.String())}
+	}
+	for _, id := range strings.Fields(cmd.stdout.String()) {
+		inUse[id] = true
+	}
+	return inUse, nil
+}
+
+func (r *composeCLIRunner) PruneBuildCache(project ComposeProject, keepBytes int64) (int64, error) {
+	cmd := NewCmdWrap(project.Dir, "docker", "builder", "prune", "--force", "--keep-storage", fmt.Sprint(keepBytes)).RecordTo(project.Output, project.Subdomain, "prune-build-cache")
+	cmd.Run()
+	if cmd.err != nil {
+		return 0, &ComposeError{Op: "builder prune", Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stderr.String())}
+	}
+	// the last line is "Total: 1.2GB" (buildx) or "Total reclaimed space: 1.2GB" (the classic builder)
+	lines := strings.Split(strings.TrimSpace(cmd.stdout.String()), "\n")
+	if _, total, found := strings.Cut(lines[len(lines)-1], ":"); found && strings.HasPrefix(lines[len(lines)-1], "Total") {
+		return parseDockerSize(total), nil
+	}
+	return 0, nil
+}
+
+// docker runs a plain docker command (not docker compose) on behalf of the project
+func (r *composeCLIRunner) docker(project ComposeProject, step string, args ...string) error {
+	cmd := NewCmdWrap(project.Dir, "docker", args...).RecordTo(project.Output, project.Subdomain, step)
+	cmd.Run()
+	if cmd.err != nil {
+		return &ComposeError{Op: args[0], Project: project.Name, Err: cmd.err, Output: strings.TrimSpace(cmd.stdout.String() + "\n" + cmd.stderr.String())}
+	}
+	return nil
+}
+
+// Ps handles both output formats of `ps --format json`: a JSON array (older compose) or one JSON object per line
+func (r *composeCLIRunner) Ps(project ComposeProject) ([]ContainerState, error) {
+	cmd, err := r.run(project, "ps", "ps", "--all", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	type psEntry struct {
+		ID       string `json:"ID"`
+		Name     string `json:"Name"`
+		Service  string `json:"Service"`
+		State    string `json:"State"`
+		Health   string `json:"Health"`
+		ExitCode int    `json:"ExitCode"`
+		Image    string `json:"Image"`
+	}
+	var entries []psEntry
+	output := strings.TrimSpace(cmd.stdout.String())
+	if strings.HasPrefix(output, "[") {
+		if err := json.Unmarshal([]byte(output), &entries); err != nil {
+			return nil, &ComposeError{Op: "ps", Project: project.Name, Err: fmt.Errorf("failed to parse output: %v", err)}
+		}
+	} else if output != "" {
+		for _, line := range strings.Split(output, "\n") {
+			var entry psEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				return nil, &ComposeError{Op: "ps", Project: project.Name, Err: fmt.Errorf("failed to parse output: %v", err)}
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	containers := []ContainerState{}
+	for _, entry := range entries {
+		containers = append(containers, ContainerState{
+			ID:       entry.ID,
+			Name:     entry.Name,
+			Service:  entry.Service,
+			State:    entry.State,
+			Health:   entry.Health,
+			ExitCode: entry.ExitCode,
+			Image:    entry.Image,
+		})
+	}
+	return containers, nil
+}
+
+// dockerEngineRunner talks to the Docker Engine API for everything the Engine can do on its own: inspecting, listing
+// and removing a project's containers and networks and managing images. Build, Pull, Up, Scale and ComposeVersion
+// go through the CLI runner, see ComposeLifecycle.
+type dockerEngineRunner struct {
+	client *dockerClient
+	cli    *composeCLIRunner
+}
+
+func newDockerEngineRunner(client *dockerClient, cli *composeCLIRunner) *dockerEngineRunner {
+	return &dockerEngineRunner{client: client, cli: cli}
+}
+
+func (r *dockerEngineRunner) Ps(project ComposeProject) ([]ContainerState, error) {
+	containers, err := r.client.ListContainers(map[string][]string{"label": {"com.docker.compose.project=" + project.Name}})
+	if err != nil {
+		return nil, &ComposeError{Op: "ps", Project: project.Name, Err: err}
+	}
+
+	states := []ContainerState{}
+	for _, container := range containers {
+		// the list endpoint only has a human readable status, inspect for the exit code, health and the image name
+		// the container was created from (the list shows the image ID once the name moved to a newer build)
+		inspect, err := r.client.InspectContainer(container.ID)
+		if isDockerNotFound(err) {
+			// removed between listing and inspecting
+			continue
+		} else if err != nil {
+			return nil, &ComposeError{Op: "ps", Project: project.Name, Err: err}
+		}
+		states = append(states, inspect.info().ContainerState)
+	}
+	return states, nil
+}
+
+// Down stops and removes the project's containers and networks, like `docker compose down` (volumes are kept)
+func (r *dockerEngineRunner) Down(project ComposeProject) error {
+	out := newLineWriter(project.Output, project.Subdomain, "down", "stdout")
+	record := newEngineRecord(project, "down")
+	err := r.down(project, out)
+	out.Flush()
+	record.finish(err)
+	return err
+}
+
+func (r *dockerEngineRunner) down(project ComposeProject, out *lineWriter) error {
+	filters := map[string][]string{"label": {"com.docker.compose.project=" + project.Name}}
+	containers, err := r.client.ListContainers(filters)
+	if err != nil {
+		return &ComposeError{Op: "down", Project: project.Name, Err: err}
+	}
+	for _, container := range containers {
+		name := container.ID
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		fmt.Fprintf(out, "Stopping container %s\n", name)
+		if err := r.client.StopContainer(container.ID, 10); err != nil && !isDockerNotFound(err) {
+			return &ComposeError{Op: "down", Project: project.Name, Err: err}
+		}
+		fmt.Fprintf(out, "Removing container %s\n", name)
+		if err := r.client.RemoveContainer(container.ID); err != nil && !isDockerNotFound(err) {
+			return &ComposeError{Op: "down", Project: project.Name, Err: err}
+		}
+	}
+
+	networks, err := r.client.ListNetworks(filters)
+	if err != nil {
+		return &ComposeError{Op: "down", Project: project.Name, Err: err}
+	}
+	for _, network := range networks {
+		fmt.Fprintf(out, "Removing network %s\n", network.Name)
+		if err := r.client.RemoveNetwork(network.ID); err != nil && !isDockerNotFound(err) {
+			return &ComposeError{Op: "down", Project: project.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+func (r *dockerEngineRunner) InspectContainer(project ComposeProject, id string) (*ContainerInfo, error) {
+	inspect, err := r.client.InspectContainer(id)
+	if err != nil {
+		return nil, &ComposeError{Op: "inspect", Project: project.Name, Err: err}
+	}
+	return inspect.info(), nil
+}
+
+func (r *dockerEngineRunner) RemoveContainer(project ComposeProject, id string) error {
+	record := newEngineRecord(project, "remove-container")
+	err := r.client.StopContainer(id, 10)
+	if err == nil {
+		err = r.client.RemoveContainer(id)
+	}
+	if err != nil {
+		err = &ComposeError{Op: "remove-container", Project: project.Name, Err: err}
+	}
+	record.finish(err)
+	return err
+}
+
+func (r *dockerEngineRunner) TagImage(project ComposeProject, source string, target string) error {
+	record := newEngineRecord(project, "tag-image")
+	err := r.client.TagImage(source, target)
+	if err != nil {
+		err = &ComposeError{Op: "tag-image", Project: project.Name, Err: err}
+	}
+	record.finish(err)
+	return err
+}
+
+func (r *dockerEngineRunner) ImageDigest(project ComposeProject, image string) (string, error) {
+	inspect, err := r.client.InspectImage(image)
+	if err != nil {
+		return "", &ComposeError{Op: "image inspect", Project: project.Name, Err: err}
+	}
+	return inspect.digest(image), nil
+}
+
+func (r *dockerEngineRunner) RemoveImage(project ComposeProject, image string) error {
+	record := newEngineRecord(project, "remove-image")
+	err := r.client.RemoveImage(image)
+	if err != nil {
+		err = &ComposeError{Op: "remove-image", Project: project.Name, Err: err}
+	}
+	record.finish(err)
+	return err
+}
+
+func (r *dockerEngineRunner) ContainerLogs(ctx context.Context, project ComposeProject, id string, opts LogOptions) error {
+	query := url.Values{"timestamps": {"1"}}
+	if opts.Follow {
+		query.Set("follow", "1")
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", fmt.Sprintf("%d.%09d", opts.Since.Unix(), opts.Since.Nanosecond()))
+	}
+	if opts.Tail >= 0 {
+		query.Set("tail", strconv.Itoa(opts.Tail))
+	}
+	stdout := newLineWriter(project.Output, project.Subdomain, "logs", "stdout")
+	stderr := newLineWriter(project.Output, project.Subdomain, "logs", "stderr")
+	err := r.client.ContainerLogs(ctx, id, query, stdout, stderr)
+	stdout.Flush()
+	stderr.Flush()
+	if err != nil {
+		return &ComposeError{Op: "logs", Project: project.Name, Err: err}
+	}
+	return nil
+}
+
+func (r *dockerEngineRunner) Stats(project ComposeProject) ([]ContainerUsage, error) {
+	containers, err := r.Ps(project)
+	if err != nil {
+		return nil, err
+	}
+	var running []ContainerState
+	for _, container := range containers {
+		if container.State == "running" {
+			running = append(running, container)
+		}
+	}
+
+	// every request takes a second or two while the Engine samples the CPU, so the containers are sampled at the same time
+	usages := make([]*ContainerUsage, len(running))
+	errs := make([]error, len(running))
+	var wg sync.WaitGroup
+	for i, container := range running {
+		wg.Add(1)
+		go func(i int, container ContainerState) {
+			defer wg.Done()
+			stats, err := r.client.ContainerStats(container.ID)
+			if isDockerNotFound(err) {
+				return
+			} else if err != nil {
+				errs[i] = &ComposeError{Op: "stats", Project: project.Name, Err: err}
+				return
+			}
+			usage := stats.usage()
+			usage.ID, usage.Name, usage.Service = container.ID, container.Name, container.Service
+			usages[i] = &usage
+		}(i, container)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	result := []ContainerUsage{}
+	for _, usage := range usages {
+		if usage != nil {
+			result = append(result, *usage)
+		}
+	}
+	return result, nil
+}
+
+func (r *dockerEngineRunner) ListImages(project ComposeProject) ([]ImageInfo, error) {
+	summaries, err := r.client.ListImages()
+	if err != nil {
+		return nil, &ComposeError{Op: "image ls", Project: project.Name, Err: err}
+	}
+	images := []ImageInfo{}
+	for _, summary := range summaries {
+		images = append(images, summary.info())
+	}
+	return images, nil
+}
+
+func (r *dockerEngineRunner) ImagesInUse(project ComposeProject) (map[string]bool, error) {
+	containers, err := r.client.ListContainers(map[string][]string{})
+	if err != nil {
+		return nil, &ComposeError{Op: "ps", Project: project.Name, Err: err}
+	}
+	inUse := make(map[string]bool)
+	for _, container := range containers {
+		inUse[container.ImageID] = true
+	}
+	return inUse, nil
+}
+
+func (r *dockerEngineRunner) PruneBuildCache(project ComposeProject, keepBytes int64) (int64, error) {
+	record := newEngineRecord(project, "prune-build-cache")
+	reclaimed, err := r.client.PruneBuildCache(keepBytes)
+	if err != nil {
+		err = &ComposeError{Op: "builder prune", Project: project.Name, Err: err}
+	}
+	record.finish(err)
+	return reclaimed, err
+}
+
+func (r *dockerEngineRunner) Scale(project ComposeProject, service string, replicas int) error {
+	return r.cli.Scale(project, service, replicas)
+}
+
+func (r *dockerEngineRunner) Build(project ComposeProject) error {
+	return r.cli.Build(project)
+}
+
+func (r *dockerEngineRunner) Pull(project ComposeProject) error {
+	return r.cli.Pull(project)
+}
+
+func (r *dockerEngineRunner) Up(project ComposeProject) error {
+	return r.cli.Up(project)
+}
+
+func (r *dockerEngineRunner) ComposeVersion(project ComposeProject) (string, error) {
+	return r.cli.ComposeVersion(project)
+}
+
+// engineRecord adds an entry for an Engine API operation to the output, the same way CmdWrap does for commands
+type engineRecord struct {
+	project ComposeProject
+	record  CommandRecord
+}
+
+func newEngineRecord(project ComposeProject, step string) *engineRecord {
+	return &engineRecord{project: project, record: CommandRecord{
+		Subdomain: project.Subdomain,
+		Step:      step,
+		Command:   fmt.Sprintf("docker engine api: %s project %s", step, project.Name),
+		StartedAt: time.Now(),
+	}}
+}
+
+func (e *engineRecord) finish(err error) {
+	e.record.FinishedAt = time.Now()
+	if err != nil {
+		e.record.Error = err.Error()
+	}
+	e.project.Output.Add(e.record)
+}
+
+// isProjectRunning reports whether any container of the project is running
+func isProjectRunning(containers []ContainerState) bool {
+	for _, container := range containers {
+		if container.State == "running" || container.State == "restarting" {
+			return true
+		}
+	}
+	return false
+}
+
+var errProjectStillRunning = errors.New("containers of the project are still running")
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the oldest API version that has everything used here, the Engine accepts it unless it is older than that
+const DOCKER_API_VERSION = "v1.41"
+
+// DockerAPIError is a non 2xx response of the Docker Engine API
+type DockerAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerAPIError) Error() string {
+	return fmt.Sprintf("docker engine api returned %d: %s", e.StatusCode, e.Message)
+}
+
+func isDockerNotFound(err error) bool {
+	var apiErr *DockerAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// dockerClient is a minimal Docker Engine API client talking HTTP over the unix socket
+type dockerClient struct {
+	socket string
+	http   *http.Client
+}
+
+func newDockerClient(socket string) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{socket: socket, http: &http.Client{Transport: transport}}
+}
+
+type dockerContainer struct {
+	ID      string            `json:"Id"`
+	Names   []string          `json:"Names"`
+	Image   string            `json:"Image"`
+	ImageID string            `json:"ImageID"`
+	State   string            `json:"State"`
+	Labels  map[string]string `json:"Labels"`
+}
+
+type dockerContainerInspect struct {
+	ID           string `json:"Id"`
+	Name         string `json:"Name"`
+	RestartCount int    `json:"RestartCount"`
+	State        struct {
+		Status    string `json:"Status"`
+		ExitCode  int    `json:"ExitCode"`
+		StartedAt string `json:"StartedAt"`
+		Health    *struct {
+			Status string `json:"Status"`
+			Log    []struct {
+				ExitCode int    `json:"ExitCode"`
+				Output   string `json:"Output"`
+			} `json:"Log"`
+		} `json:"Health"`
+	} `json:"State"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+		Tty    bool              `json:"Tty"`
+	} `json:"Config"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+		// Ports maps container ports (e.g. "80/tcp") to the host addresses they are published on, null if not published
+		Ports map[string][]struct {
+			HostIP   string `json:"HostIp"`
+			HostPort string `json:"HostPort"`
+		} `json:"Ports"`
+	} `json:"NetworkSettings"`
+}
+
+// info converts the Engine's view of a container into the runner independent ContainerInfo
+func (inspect *dockerContainerInspect) info() *ContainerInfo {
+	info := &ContainerInfo{
+		ContainerState: ContainerState{
+			ID:       inspect.ID,
+			Name:     strings.TrimPrefix(inspect.Name, "/"),
+			Service:  inspect.Config.Labels["com.docker.compose.service"],
+			State:    inspect.State.Status,
+			ExitCode: inspect.State.ExitCode,
+			Image:    inspect.Config.Image,
+		},
+		RestartCount: inspect.RestartCount,
+		Networks:     make(map[string]string),
+		Ports:        []PublishedPort{},
+		Routers:      []TraefikRouter{},
+	}
+	if startedAt, err := time.Parse(time.RFC3339Nano, inspect.State.StartedAt); err == nil {
+		info.StartedAt = startedAt
+	}
+	if inspect.State.Health != nil {
+		info.Health = inspect.State.Health.Status
+		if len(inspect.State.Health.Log) > 0 {
+			info.HealthOutput = strings.TrimSpace(inspect.State.Health.Log[len(inspect.State.Health.Log)-1].Output)
+		}
+	}
+	for name, network := range inspect.NetworkSettings.Networks {
+		info.Networks[name] = network.IPAddress
+	}
+	for containerPort, bindings := range inspect.NetworkSettings.Ports {
+		for _, binding := range bindings {
+			info.Ports = append(info.Ports, PublishedPort{ContainerPort: containerPort, HostIP: binding.HostIP, HostPort: binding.HostPort})
+		}
+	}
+	sort.Slice(info.Ports, func(i, k int) bool {
+		return info.Ports[i].ContainerPort+info.Ports[i].HostIP < info.Ports[k].ContainerPort+info.Ports[k].HostIP
+	})
+	for label, rule := range inspect.Config.Labels {
+		if name, ok := strings.CutPrefix(label, "traefik.http.routers."); ok && strings.HasSuffix(name, ".rule") {
+			info.Routers = append(info.Routers, TraefikRouter{Name: strings.TrimSuffix(name, ".rule"), Rule: rule})
+		}
+	}
+	sort.Slice(info.Routers, func(i, k int) bool { return info.Routers[i].Name < info.Routers[k].Name })
+	return info
+}
+
+type dockerImageInspect struct {
+	ID          string   `json:"Id"`
+	RepoTags    []string `json:"RepoTags"`
+	RepoDigests []string `json:"RepoDigests"`
+	Created     string   `json:"Created"`
+	Size        int64    `json:"Size"`
+	Config      struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+func (inspect *dockerImageInspect) info() ImageInfo {
+	info := ImageInfo{ID: inspect.ID, Tags: []string{}, Digests: []string{}, Labels: inspect.Config.Labels, Size: inspect.Size}
+	info.Tags = append(info.Tags, inspect.RepoTags...)
+	info.Digests = append(info.Digests, inspect.RepoDigests...)
+	if created, err := time.Parse(time.RFC3339Nano, inspect.Created); err == nil {
+		info.Created = created
+	}
+	return info
+}
+
+// dockerImageSummary is an entry of the image list, which has the same information as an inspect in a different shape
+type dockerImageSummary struct {
+	ID          string            `json:"Id"`
+	RepoTags    []string          `json:"RepoTags"`
+	RepoDigests []string          `json:"RepoDigests"`
+	Created     int64             `json:"Created"`
+	Size        int64             `json:"Size"`
+	Labels      map[string]string `json:"Labels"`
+}
+
+func (summary *dockerImageSummary) info() ImageInfo {
+	info := ImageInfo{ID: summary.ID, Tags: []string{}, Digests: []string{}, Labels: summary.Labels, Created: time.Unix(summary.Created, 0), Size: summary.Size}
+	// older Engines list untagged images as <none>:<none> and <none>@<none>
+	for _, tag := range summary.RepoTags {
+		if !strings.HasPrefix(tag, "<none>") {
+			info.Tags = append(info.Tags, tag)
+		}
+	}
+	for _, digest := range summary.RepoDigests {
+		if !strings.HasPrefix(digest, "<none>") {
+			info.Digests = append(info.Digests, digest)
+		}
+	}
+	return info
+}
+
+// digest prefers the repository digest of the repository image was pulled from, locally built images only have an ID
+func (inspect *dockerImageInspect) digest(image string) string {
+	repository, _ := splitImageReference(image)
+	for _, digest := range inspect.RepoDigests {
+		if strings.HasPrefix(digest, repository+"@") {
+			return digest
+		}
+	}
+	if len(inspect.RepoDigests) > 0 {
+		return inspect.RepoDigests[0]
+	}
+	return inspect.ID
+}
+
+type dockerNetwork struct {
+	ID   string `json:"Id"`
+	Name string `json:"Name"`
+}
+
+// do sends the request and decodes a JSON response into result when it is not nil
+func (c *dockerClient) do(method string, path string, query url.Values, timeout time.Duration, result interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := c.request(ctx, method, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// request sends the request and returns the response of a successful one, the caller closes its body
+func (c *dockerClient) request(ctx context.Context, method string, path string, query url.Values) (*http.Response, error) {
+	target := "http://docker/" + DOCKER_API_VERSION + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the docker engine on %s: %v", c.socket, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		apiErr := &DockerAPIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+		var message struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &message) == nil && message.Message != "" {
+			apiErr.Message = message.Message
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+func (c *dockerClient) Ping() error {
+	return c.do(http.MethodGet, "/_ping", nil, 2*time.Second, nil)
+}
+
+func encodeDockerFilters(filters map[string][]string) url.Values {
+	encoded, _ := json.Marshal(filters)
+	return url.Values{"filters": {string(encoded)}}
+}
+
+func (c *dockerClient) ListContainers(filters map[string][]string) ([]dockerContainer, error) {
+	query := encodeDockerFilters(filters)
+	query.Set("all", "1")
+	var containers []dockerContainer
+	err := c.do(http.MethodGet, "/containers/json", query, 30*time.Second, &containers)
+	return containers, err
+}
+
+func (c *dockerClient) InspectContainer(id string) (*dockerContainerInspect, error) {
+	var inspect dockerContainerInspect
+	if err := c.do(http.MethodGet, "/containers/"+url.PathEscape(id)+"/json", nil, 30*time.Second, &inspect); err != nil {
+		return nil, err
+	}
+	return &inspect, nil
+}
+
+// StopContainer gives the container timeoutSeconds to exit before it is killed, stopping a stopped container is not an error
+func (c *dockerClient) StopContainer(id string, timeoutSeconds int) error {
+	query := url.Values{"t": {fmt.Sprint(timeoutSeconds)}}
+	err := c.do(http.MethodPost, "/containers/"+url.PathEscape(id)+"/stop", query, time.Duration(timeoutSeconds+30)*time.Second, nil)
+	var apiErr *DockerAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	return err
+}
+
+// RemoveContainer keeps the container's volumes, like `docker compose down` without --volumes
+func (c *dockerClient) RemoveContainer(id string) error {
+	return c.do(http.MethodDelete, "/containers/"+url.PathEscape(id), nil, 30*time.Second, nil)
+}
+
+func (c *dockerClient) ListNetworks(filters map[string][]string) ([]dockerNetwork, error) {
+	var networks []dockerNetwork
+	err := c.do(http.MethodGet, "/networks", encodeDockerFilters(filters), 30*time.Second, &networks)
+	return networks, err
+}
+
+func (c *dockerClient) RemoveNetwork(id string) error {
+	return c.do(http.MethodDelete, "/networks/"+url.PathEscape(id), nil, 30*time.Second, nil)
+}
+
+// splitImageReference splits "registry:5000/name:tag" into the repository and the tag, which defaults to latest
+func splitImageReference(reference string) (string, string) {
+	repository, tag := reference, "latest"
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		repository, tag = reference[:i], reference[i+1:]
+	}
+	return repository, tag
+}
+
+// image references go into the path as they are, the Engine expects the slashes of repository names unescaped
+func (c *dockerClient) TagImage(source string, target string) error {
+	repository, tag := splitImageReference(target)
+	query := url.Values{"repo": {repository}, "tag": {tag}}
+	return c.do(http.MethodPost, "/images/"+source+"/tag", query, 30*time.Second, nil)
+}
+
+func (c *dockerClient) InspectImage(image string) (*dockerImageInspect, error) {
+	var inspect dockerImageInspect
+	if err := c.do(http.MethodGet, "/images/"+image+"/json", nil, 30*time.Second, &inspect); err != nil {
+		return nil, err
+	}
+	return &inspect, nil
+}
+
+func (c *dockerClient) ListImages() ([]dockerImageSummary, error) {
+	var images []dockerImageSummary
+	err := c.do(http.MethodGet, "/images/json", nil, 60*time.Second, &images)
+	return images, err
+}
+
+// PruneBuildCache removes build cache that isn't in use until at most keepBytes are left, returning the space it freed
+func (c *dockerClient) PruneBuildCache(keepBytes int64) (int64, error) {
+	var result struct {
+		SpaceReclaimed int64 `json:"SpaceReclaimed"`
+	}
+	query := url.Values{"keep-storage": {fmt.Sprint(keepBytes)}}
+	err := c.do(http.MethodPost, "/build/prune", query, 10*time.Minute, &result)
+	return result.SpaceReclaimed, err
+}
+
+func (c *dockerClient) RemoveImage(image string) error {
+	return c.do(http.MethodDelete, "/images/"+image, nil, 60*time.Second, nil)
+}
+
+// ContainerLogs writes the container's stdout and stderr to the given writers until the logs end or ctx is done.
+// The query takes the parameters of the logs endpoint, e.g. timestamps, follow, since and tail.
+func (c *dockerClient) ContainerLogs(ctx context.Context, id string, query url.Values, stdout io.Writer, stderr io.Writer) error {
+	inspect, err := c.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	resp, err := c.request(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/logs", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// with a TTY both streams arrive as one raw stream, otherwise they are multiplexed in frames
+	if inspect.Config.Tty {
+		_, err = io.Copy(stdout, resp.Body)
+	} else {
+		err = demuxDockerStream(resp.Body, stdout, stderr)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// demuxDockerStream splits a multiplexed stream into stdout and stderr. Every frame starts with an 8 byte header:
+// the stream (1 stdout, 2 stderr), three zero bytes and the big endian length of the payload.
+func demuxDockerStream(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+type dockerCPUStats struct {
+	CPUUsage struct {
+		TotalUsage uint64 `json:"total_usage"`
+	} `json:"cpu_usage"`
+	SystemUsage uint64 `json:"system_cpu_usage"`
+	OnlineCPUs  uint32 `json:"online_cpus"`
+}
+
+type dockerContainerStats struct {
+	CPUStats    dockerCPUStats `json:"cpu_stats"`
+	PreCPUStats dockerCPUStats `json:"precpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+	Networks map[string]struct {
+		RxBytes uint64 `json:"rx_bytes"`
+		TxBytes uint64 `json:"tx_bytes"`
+	} `json:"networks"`
+	BlkioStats struct {
+		IoServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value uint64 `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+}
+
+// usage computes the numbers `docker stats` shows from the raw counters of the Engine
+func (stats *dockerContainerStats) usage() ContainerUsage {
+	var usage ContainerUsage
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		usage.CPUPercent = cpuDelta / systemDelta * float64(stats.CPUStats.OnlineCPUs) * 100
+	}
+	// the page cache counts towards usage but is reclaimable, docker stats leaves it out too (cgroup v1 and v2 names)
+	cache := stats.MemoryStats.Stats["total_inactive_file"]
+	if v2, ok := stats.MemoryStats.Stats["inactive_file"]; ok {
+		cache = v2
+	}
+	if stats.MemoryStats.Usage > cache {
+		usage.MemoryBytes = int64(stats.MemoryStats.Usage - cache)
+	}
+	for _, network := range stats.Networks {
+		usage.NetRxBytes += int64(network.RxBytes)
+		usage.NetTxBytes += int64(network.TxBytes)
+	}
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			usage.BlockReadBytes += int64(entry.Value)
+		case "write":
+			usage.BlockWriteBytes += int64(entry.Value)
+		}
+	}
+	return usage
+}
+
+// ContainerStats waits for the Engine to take two samples, which it needs for the CPU usage
+func (c *dockerClient) ContainerStats(id string) (*dockerContainerStats, error) {
+	var stats dockerContainerStats
+	if err := c.do(http.MethodGet, "/containers/"+url.PathEscape(id)+"/stats", url.Values{"stream": {"false"}}, 30*time.Second, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
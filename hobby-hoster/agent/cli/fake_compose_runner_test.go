@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeComposeInspector records the inspections it is asked for and fails the ones errs has an error for
+type fakeComposeInspector struct {
+	mu    sync.Mutex
+	calls []string
+	// errs maps an operation (e.g. "Build") to the error it returns
+	errs map[string]error
+	// containers are what Ps returns, InspectContainer returns them with state
+	containers []ContainerState
+	state      string
+	exitCode   int
+	// images are what ListImages returns
+	images []ImageInfo
+}
+
+func newFakeComposeInspector() *fakeComposeInspector {
+	return &fakeComposeInspector{errs: make(map[string]error), state: "running"}
+}
+
+func (r *fakeComposeInspector) record(op string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, op)
+	return r.errs[op]
+}
+
+// called reports whether the operation ran, and how often
+func (r *fakeComposeInspector) called(op string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, call := range r.calls {
+		if call == op {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *fakeComposeInspector) Ps(project ComposeProject) ([]ContainerState, error) {
+	if err := r.record("Ps"); err != nil {
+		return nil, err
+	}
+	return r.containers, nil
+}
+
+func (r *fakeComposeInspector) InspectContainer(project ComposeProject, id string) (*ContainerInfo, error) {
+	if err := r.record("InspectContainer"); err != nil {
+		return nil, err
+	}
+	for _, container := range r.containers {
+		if container.ID == id {
+			container.State = r.state
+			container.ExitCode = r.exitCode
+			return &ContainerInfo{ContainerState: container, StartedAt: time.Now().Add(-time.Hour), Networks: map[string]string{}}, nil
+		}
+	}
+	return nil, &ComposeError{Op: "inspect", Project: project.Name}
+}
+
+func (r *fakeComposeInspector) ImageDigest(project ComposeProject, image string) (string, error) {
+	return "sha256:" + image, r.record("ImageDigest")
+}
+
+func (r *fakeComposeInspector) ContainerLogs(ctx context.Context, project ComposeProject, id string, opts LogOptions) error {
+	return r.record("ContainerLogs")
+}
+
+func (r *fakeComposeInspector) Stats(project ComposeProject) ([]ContainerUsage, error) {
+	return nil, r.record("Stats")
+}
+
+func (r *fakeComposeInspector) ListImages(project ComposeProject) ([]ImageInfo, error) {
+	err := r.record("ListImages")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.images, err
+}
+
+func (r *fakeComposeInspector) ImagesInUse(project ComposeProject) (map[string]bool, error) {
+	return map[string]bool{}, r.record("ImagesInUse")
+}
+
+// fakeComposeRunner is a fakeComposeInspector that also records the lifecycle operations, in the same calls
+type fakeComposeRunner struct {
+	*fakeComposeInspector
+	// RemoveImage records the references it removes in removed and drops them from images
+	removed []string
+	// version is what ComposeVersion returns
+	version string
+}
+
+func newFakeComposeRunner() *fakeComposeRunner {
+	return &fakeComposeRunner{fakeComposeInspector: newFakeComposeInspector(), version: "2.24.6"}
+}
+
+func (r *fakeComposeRunner) Down(project ComposeProject) error  { return r.record("Down") }
+func (r *fakeComposeRunner) Build(project ComposeProject) error { return r.record("Build") }
+func (r *fakeComposeRunner) Pull(project ComposeProject) error  { return r.record("Pull") }
+func (r *fakeComposeRunner) Up(project ComposeProject) error    { return r.record("Up") }
+
+func (r *fakeComposeRunner) Scale(project ComposeProject, service string, replicas int) error {
+	return r.record("Scale")
+}
+
+func (r *fakeComposeRunner) RemoveContainer(project ComposeProject, id string) error {
+	return r.record("RemoveContainer")
+}
+
+func (r *fakeComposeRunner) TagImage(project ComposeProject, source string, target string) error {
+	return r.record("TagImage")
+}
+
+func (r *fakeComposeRunner) RemoveImage(project ComposeProject, image string) error {
+	if err := r.record("RemoveImage"); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removed = append(r.removed, image)
+	// like docker, the image is gone once its last tag is
+	var images []ImageInfo
+	for _, info := range r.images {
+		var tags []string
+		for _, tag := range info.Tags {
+			if tag != image {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) > 0 || len(tags) == len(info.Tags) {
+			info.Tags = tags
+			images = append(images, info)
+		}
+	}
+	r.images = images
+	return nil
+}
+
+func (r *fakeComposeRunner) ComposeVersion(project ComposeProject) (string, error) {
+	return r.version, r.record("ComposeVersion")
+}
+
+func (r *fakeComposeRunner) PruneBuildCache(project ComposeProject, keepBytes int64) (int64, error) {
+	return 0, r.record("PruneBuildCache")
+}
+
+// useComposeRunner makes getComposeRunner return runner (a nil runner picks one by DOCKER_BACKEND again) and points
+// everything the agent keeps under /mnt/data at a temporary directory, until the test ends
+func useComposeRunner(t *testing.T, runner ComposeRunner) {
+	dir := t.TempDir()
+	paths := map[*string]string{
+		&ROOT_PROJECT_DIR:          dir + "/projects",
+		&RELEASES_DIR:              dir + "/releases",
+		&LOCKS_DIR:                 dir + "/locks",
+		&JOBS_DIR:                  dir + "/jobs",
+		&PORT_REGISTRY_FILE:        dir + "/port-registry.json",
+		&RESOURCE_LIMITS_FILE:      dir + "/resource-limits.json",
+		&DESIRED_STATE_FILE:        dir + "/desired-state.json",
+		&REGISTRY_CREDENTIALS_FILE: dir + "/registry-credentials.json",
+		&WEBHOOK_SECRETS_FILE:      dir + "/webhook-secrets.json",
+		&FAILED_DEPLOYS_FILE:       dir + "/failed-deploys.json",
+	}
+	previous := make(map[*string]string)
+	for variable, path := range paths {
+		previous[variable] = *variable
+		*variable = path
+	}
+	t.Cleanup(func() {
+		for variable, path := range previous {
+			*variable = path
+		}
+		composeRunner = nil
+		composeRunnerOnce = sync.Once{}
+	})
+	composeRunner = runner
+	composeRunnerOnce = sync.Once{}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ImageInfo is an image on the host
+type ImageInfo struct {
+	ID      string            `json:"id"`
+	Tags    []string          `json:"tags"`
+	Digests []string          `json:"digests"`
+	Labels  map[string]string `json:"labels"`
+	Created time.Time         `json:"created"`
+	Size    int64             `json:"size"`
+}
+
+type GCOptions struct {
+	// Keep is the number of most recent images kept per service of a project
+	Keep int
+	// BuildCacheBudget is how much build cache is left after pruning, -1 leaves the build cache alone
+	BuildCacheBudget int64
+	DryRun           bool
+}
+
+type ProjectGCResult struct {
+	Subdomain string      `json:"subdomain"`
+	Removed   []ImageInfo `json:"removed"`
+	// ReclaimedBytes adds up the sizes of the removed images, layers they shared with kept images are not actually freed
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+	Errors         []string `json:"errors,omitempty"`
+	// Skipped is set when another operation was working on the project, its images are collected next time
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+type GCResult struct {
+	DryRun                   bool              `json:"dry_run"`
+	Projects                 []ProjectGCResult `json:"projects"`
+	BuildCacheReclaimedBytes int64             `json:"build_cache_reclaimed_bytes"`
+	ReclaimedBytes           int64             `json:"reclaimed_bytes"`
+}
+
+// imageRepository returns the repository of a tag (nginx:1.25) or digest (nginx@sha256:...)
+func imageRepository(reference string) string {
+	if repository, _, found := strings.Cut(reference, "@"); found {
+		return repository
+	}
+	repository, _ := splitImageReference(reference)
+	return repository
+}
+
+// isReleaseImage reports whether the image is kept for rolling back to, see getReleaseImageTag
+func isReleaseImage(image ImageInfo) bool {
+	for _, tag := range image.Tags {
+		if strings.HasPrefix(tag, "hobby-hoster-release/") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeImageReference adds the latest tag compose and docker assume to a reference without a tag or digest
+func normalizeImageReference(reference string) string {
+	if strings.Contains(reference, "@") {
+		return reference
+	}
+	repository, tag := splitImageReference(reference)
+	return repository + ":" + tag
+}
+
+// referencedImages returns the IDs of the images the compose file of any of the projects refers to. Pulled images
+// are grouped by repository, so without this the GC of one project would count the tag another project runs of the
+// same repository as an old version of its own.
+func referencedImages(subdomains []string, images []ImageInfo) (map[string]bool, error) {
+	references := make(map[string]bool)
+	for _, subdomain := range subdomains {
+		pulled, _, err := composeImages(getProjectPath(subdomain))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the images of %s: %v", subdomain, err)
+		}
+		for _, image := range pulled {
+			references[normalizeImageReference(image)] = true
+		}
+	}
+	referenced := make(map[string]bool)
+	for _, image := range images {
+		for _, reference := range append(append([]string{}, image.Tags...), image.Digests...) {
+			if references[normalizeImageReference(reference)] {
+				referenced[image.ID] = true
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// projectImages groups the images of a project by what they are versions of: images compose built for a service
+// carry the project and service labels, images of services that are pulled are recognized by their repository
+func projectImages(subdomain string, images []ImageInfo) (map[string][]ImageInfo, error) {
+	pulled, _, err := composeImages(getProjectPath(subdomain))
+	if err != nil {
+		return nil, err
+	}
+	repositories := make(map[string]bool)
+	for _, image := range pulled {
+		repositories[imageRepository(image)] = true
+	}
+
+	name := composeProjectName(subdomain)
+	groups := make(map[string][]ImageInfo)
+	for _, image := range images {
+		if image.Labels["com.docker.compose.project"] == name {
+			group := "service " + image.Labels["com.docker.compose.service"]
+			groups[group] = append(groups[group], image)
+			continue
+		}
+		for _, reference := range append(append([]string{}, image.Tags...), image.Digests...) {
+			if repository := imageRepository(reference); repositories[repository] {
+				groups[repository] = append(groups[repository], image)
+				break
+			}
+		}
+	}
+	return groups, nil
+}
+
+// gcProject removes all but the most recent opts.Keep images of every service of the project. Images a container
+// was created from or a project refers to (inUse) and images kept for rollbacks are never removed, even when they are older.
+func gcProject(runner ComposeRunner, project ComposeProject, images []ImageInfo, inUse map[string]bool, opts GCOptions) ProjectGCResult {
+	result := ProjectGCResult{Subdomain: project.Subdomain, Removed: []ImageInfo{}}
+	groups, err := projectImages(project.Subdomain, images)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	for _, versions := range groups {
+		sort.SliceStable(versions, func(i, k int) bool { return versions[i].Created.After(versions[k].Created) })
+		for i, image := range versions {
+			if i < opts.Keep || inUse[image.ID] || isReleaseImage(image) {
+				continue
+			}
+			if !opts.DryRun {
+				if err := removeImage(runner, project, image); err != nil {
+					result.Errors = append(result.Errors, err.Error())
+					continue
+				}
+			}
+			result.Removed = append(result.Removed, image)
+			result.ReclaimedBytes += image.Size
+		}
+	}
+	sort.Slice(result.Removed, func(i, k int) bool { return result.Removed[i].Created.Before(result.Removed[k].Created) })
+	return result
+}
+
+// removeImage removes every tag of the image, which deletes it with the last one. Removing a tagged image by its ID
+// fails when it has more than one tag.
+func removeImage(runner ComposeRunner, project ComposeProject, image ImageInfo) error {
+	if len(image.Tags) == 0 {
+		return runner.RemoveImage(project, image.ID)
+	}
+	for _, tag := range image.Tags {
+		if err := runner.RemoveImage(project, tag); err != nil && !isDockerNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listGCImages lists the images on the host and the ones gcProject must keep: the ones a container was created from
+// and the ones the compose file of any of the projects refers to
+func listGCImages(runner ComposeRunner, host ComposeProject, subdomains []string) ([]ImageInfo, map[string]bool, error) {
+	images, err := runner.ListImages(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	inUse, err := runner.ImagesInUse(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	referenced, err := referencedImages(subdomains, images)
+	if err != nil {
+		return nil, nil, err
+	}
+	for id := range referenced {
+		inUse[id] = true
+	}
+	return images, inUse, nil
+}
+
+// collectGarbage removes old images of every deployed project and prunes the build cache down to its budget
+func collectGarbage(opts GCOptions, out *OpOutput) (GCResult, []string) {
+	result := GCResult{DryRun: opts.DryRun, Projects: []ProjectGCResult{}}
+	runner := getComposeRunner()
+	host := ComposeProject{Dir: ROOT_PROJECT_DIR, Output: out}
+
+	services, err := listServices()
+	if err != nil {
+		return result, []string{err.Error()}
+	}
+	var subdomains []string
+	for _, service := range services {
+		subdomains = append(subdomains, service.Subdomain)
+	}
+
+	var errs []string
+	for _, service := range services {
+		// a deploy in progress may be about to run an image that looks old
+		lock, err := tryLockProject(service.Subdomain)
+		if errors.Is(err, errLocked) {
+			result.Projects = append(result.Projects, ProjectGCResult{Subdomain: service.Subdomain, Removed: []ImageInfo{}, Skipped: true})
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", service.Subdomain, err))
+			continue
+		}
+		// the images are listed once the project is locked, a deploy that finished while an earlier project was
+		// collected has built or pulled new ones and may have started containers from them
+		images, inUse, err := listGCImages(runner, host, subdomains)
+		if err != nil {
+			lock.Unlock()
+			return result, append(errs, err.Error())
+		}
+		projectResult := gcProject(runner, newComposeProject(service.Subdomain, out), images, inUse, opts)
+		lock.Unlock()
+		for _, err := range projectResult.Errors {
+			errs = append(errs, fmt.Sprintf("%s: %s", service.Subdomain, err))
+		}
+		result.ReclaimedBytes += projectResult.ReclaimedBytes
+		result.Projects = append(result.Projects, projectResult)
+	}
+
+	if opts.BuildCacheBudget >= 0 && !opts.DryRun {
+		reclaimed, err := runner.PruneBuildCache(host, opts.BuildCacheBudget)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		result.BuildCacheReclaimedBytes = reclaimed
+		result.ReclaimedBytes += reclaimed
+	}
+	return result, errs
+}
+
+// parseBuildCacheBudget accepts a size like 5g, or none to leave the build cache alone
+func parseBuildCacheBudget(val string) (int64, error) {
+	if val == "none" {
+		return -1, nil
+	}
+	budget, err := parseMemory(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid build cache budget %q, expected a size like 5g or none", val)
+	}
+	return budget, nil
+}
+
+// runGarbageCollector collects garbage every interval, staying out of the way of deploys in progress
+func runGarbageCollector(interval time.Duration, opts GCOptions) {
+	busy := newBusyRounds("GC")
+	for {
+		time.Sleep(interval)
+		result, errs := collectGarbage(opts, nil)
+		var skipped []string
+		for _, project := range result.Projects {
+			if project.Skipped {
+				skipped = append(skipped, project.Subdomain)
+			}
+		}
+		busy.update(skipped)
+		for _, project := range result.Projects {
+			if len(project.Removed) > 0 {
+				log.Printf("GC: removed %d images of %s, reclaimed %s", len(project.Removed), project.Subdomain, formatBytes(project.ReclaimedBytes))
+			}
+		}
+		log.Printf("GC: reclaimed %s, %s of it build cache", formatBytes(result.ReclaimedBytes), formatBytes(result.BuildCacheReclaimedBytes))
+		for _, err := range errs {
+			log.Printf("GC: %s", err)
+		}
+	}
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove old images and build cache",
+	Long:  `This command removes all but the --keep most recent images of every service of every project and prunes the build cache down to --build-cache-budget. Images used by a container and images kept for rollbacks are never removed. It reports the space reclaimed per subdomain.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		keep, _ := cmd.Flags().GetInt("keep")
+		budgetFlag, _ := cmd.Flags().GetString("build-cache-budget")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		budget, err := parseBuildCacheBudget(budgetFlag)
+		if err == nil && keep < 1 {
+			err = errors.New("--keep must be at least 1, the current image of a service is always kept")
+		}
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		result, errs := collectGarbage(GCOptions{Keep: keep, BuildCacheBudget: budget, DryRun: dryRun}, newCLIOutput(cmd))
+		if jsonOutput {
+			resultJson, _ := json.Marshal(resultJSON(map[string]interface{}{"gc": result}, errs))
+			fmt.Println(string(resultJson))
+			return nil
+		}
+		verb := "removed"
+		if dryRun {
+			verb = "would remove"
+		}
+		for _, project := range result.Projects {
+			if project.Skipped {
+				fmt.Printf("%-20s skipped, another operation is in progress\n", project.Subdomain)
+				continue
+			}
+			fmt.Printf("%-20s %s %d images, %s\n", project.Subdomain, verb, len(project.Removed), formatBytes(project.ReclaimedBytes))
+		}
+		fmt.Printf("%-20s %s\n", "build cache", formatBytes(result.BuildCacheReclaimedBytes))
+		fmt.Printf("%-20s %s\n", "total", formatBytes(result.ReclaimedBytes))
+		if len(errs) > 0 {
+			return errors.New(fmt.Sprintf("Encountered errors during gc: %v", errs))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGCKeepsImagesOtherProjectsRefer(t *testing.T) {
+	runner := newFakeComposeRunner()
+	useComposeRunner(t, runner)
+	for subdomain, image := range map[string]string{"a": "nginx:1.25", "b": "nginx"} {
+		dir := getProjectPath(subdomain)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		compose := "services:\n  web:\n    image: " + image + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(compose), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, ".hobby-hoster-revision"), []byte("1111111"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	runner.images = []ImageInfo{
+		{ID: "sha256:old", Tags: []string{"nginx:1.24"}, Created: now.Add(-3 * time.Hour)},
+		{ID: "sha256:a", Tags: []string{"nginx:1.25"}, Created: now.Add(-2 * time.Hour)},
+		{ID: "sha256:b", Tags: []string{"nginx:latest"}, Created: now.Add(-time.Hour)},
+	}
+
+	result, errs := collectGarbage(GCOptions{Keep: 1, BuildCacheBudget: -1}, nil)
+	if len(errs) > 0 {
+		t.Fatalf("gc failed: %v", errs)
+	}
+	// both projects see the three nginx images, each may only remove the one neither of them runs. The images are
+	// listed again for the second project, which therefore doesn't try to remove it again.
+	if len(runner.removed) != 1 || runner.removed[0] != "nginx:1.24" {
+		t.Errorf("expected only nginx:1.24 to be removed once, removed %v", runner.removed)
+	}
+	for _, project := range result.Projects {
+		for _, image := range project.Removed {
+			if image.ID != "sha256:old" {
+				t.Errorf("%s removed %s", project.Subdomain, image.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the routed service is probed on the network Traefik reaches it on
+var HEALTHCHECK_NETWORK = "traefik-public"
+
+// how long a deployed container gets to become healthy unless hobby-hoster.healthcheck.timeout says otherwise
+var DEFAULT_HEALTHCHECK_TIMEOUT = 2 * time.Minute
+
+// a container without a probe or a HEALTHCHECK counts as healthy once it kept running this long
+var HEALTHCHECK_SETTLE_TIME = 5 * time.Second
+
+// HealthCheck is what a deployed container of the routed service has to pass before the deploy counts as successful.
+// It is configured with the hobby-hoster.healthcheck.path, .timeout and .expect-status labels.
+type HealthCheck struct {
+	// Path is requested over HTTP on Port when set, e.g. /healthz
+	Path    string
+	Port    string
+	Timeout time.Duration
+	// ExpectStatus is a comma separated list of status codes or classes, e.g. "200", "2xx" or "200,301"
+	ExpectStatus string
+}
+
+func getHealthCheck(hobbyHosterMetadata map[string]string) (HealthCheck, error) {
+	check := HealthCheck{
+		Path:         hobbyHosterMetadata["healthcheck.path"],
+		Port:         "80",
+		Timeout:      DEFAULT_HEALTHCHECK_TIMEOUT,
+		ExpectStatus: "2xx",
+	}
+	if port, ok := hobbyHosterMetadata["port"]; ok {
+		check.Port = port
+	}
+	if check.Path != "" && !strings.HasPrefix(check.Path, "/") {
+		check.Path = "/" + check.Path
+	}
+	if val, ok := hobbyHosterMetadata["healthcheck.timeout"]; ok {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout <= 0 {
+			return check, fmt.Errorf("invalid hobby-hoster.healthcheck.timeout label %q, expected a duration like 60s", val)
+		}
+		check.Timeout = timeout
+	}
+	if val, ok := hobbyHosterMetadata["healthcheck.expect-status"]; ok {
+		check.ExpectStatus = val
+		for _, expected := range strings.Split(val, ",") {
+			expected = strings.ToLower(strings.TrimSpace(expected))
+			if _, err := strconv.Atoi(strings.TrimSuffix(expected, "xx")); err != nil || len(expected) != 3 {
+				return check, fmt.Errorf("invalid hobby-hoster.healthcheck.expect-status label %q, expected status codes like 200 or 2xx", val)
+			}
+		}
+	}
+	return check, nil
+}
+
+func (c HealthCheck) statusMatches(status int) bool {
+	code := strconv.Itoa(status)
+	for _, expected := range strings.Split(c.ExpectStatus, ",") {
+		expected = strings.ToLower(strings.TrimSpace(expected))
+		if expected == code || (strings.HasSuffix(expected, "xx") && expected[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthCheckError is returned when a deployed container doesn't pass its health check
+type HealthCheckError struct {
+	Service     string
+	ContainerID string
+	Reason      string
+	// ProbeOutput is the result of the last HTTP probe, HealthOutput the output of the last Docker HEALTHCHECK run
+	ProbeOutput  string
+	HealthOutput string
+}
+
+func (e *HealthCheckError) Error() string {
+	message := fmt.Sprintf("health check of service %s (container %s) failed: %s", e.Service, shortContainerID(e.ContainerID), e.Reason)
+	if e.ProbeOutput != "" {
+		message += fmt.Sprintf(", last probe: %s", e.ProbeOutput)
+	}
+	if e.HealthOutput != "" {
+		message += fmt.Sprintf(", last HEALTHCHECK output: %s", e.HealthOutput)
+	}
+	return message
+}
+
+// probe requests the health check path on ip and describes the response
+func (c HealthCheck) probe(ip string) (bool, string) {
+	target := fmt.Sprintf("http://%s%s", net.JoinHostPort(ip, c.Port), c.Path)
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		// a redirect is an answer too, whether it is the expected one is up to expect-status
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		return false, fmt.Sprintf("GET %s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+	output := fmt.Sprintf("GET %s: %s", target, resp.Status)
+	// the start of the body on one line is enough to tell an error page from the app's own response
+	if excerpt := strings.Join(strings.Fields(string(body)), " "); excerpt != "" {
+		output += ": " + excerpt
+	}
+	return c.statusMatches(resp.StatusCode), output
+}
+
+// waitForHealthy waits until the container is running, Docker doesn't consider it unhealthy (or starting) and the
+// HTTP probe passes. Without a probe or HEALTHCHECK, the container only has to keep running for HEALTHCHECK_SETTLE_TIME.
+func waitForHealthy(runner ComposeInspector, project ComposeProject, service string, id string, check HealthCheck) error {
+	quiet := project
+	quiet.Output = nil
+	deadline := time.Now().Add(check.Timeout)
+	failure := func(reason string, probeOutput string, healthOutput string) error {
+		return &HealthCheckError{Service: service, ContainerID: id, Reason: reason, ProbeOutput: probeOutput, HealthOutput: healthOutput}
+	}
+
+	project.logf("healthcheck", "Waiting for container %s of service %s to become healthy", shortContainerID(id), service)
+	var lastProbe string
+	for {
+		info, err := runner.InspectContainer(quiet, id)
+		if err != nil {
+			return err
+		}
+		switch info.State {
+		case "exited", "dead":
+			return failure(fmt.Sprintf("container %s with exit code %d", info.State, info.ExitCode), lastProbe, info.HealthOutput)
+		}
+		if info.Health == "unhealthy" {
+			return failure("Docker reports the container as unhealthy", lastProbe, info.HealthOutput)
+		}
+
+		probed := check.Path == ""
+		if !probed && info.State == "running" {
+			ip := info.Networks[HEALTHCHECK_NETWORK]
+			var output string
+			if ip == "" {
+				output = fmt.Sprintf("container is not attached to the %s network", HEALTHCHECK_NETWORK)
+			} else {
+				probed, output = check.probe(ip)
+			}
+			if output != lastProbe {
+				project.logf("healthcheck", "%s", output)
+			}
+			lastProbe = output
+		}
+
+		if info.State == "running" && probed && info.Health != "starting" {
+			settled := check.Path != "" || info.Health == "healthy" || time.Since(info.StartedAt) >= HEALTHCHECK_SETTLE_TIME
+			if settled {
+				project.logf("healthcheck", "Container %s of service %s is healthy", shortContainerID(id), service)
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			state := info.State
+			if info.Health != "" {
+				state += ", " + info.Health
+			}
+			return failure(fmt.Sprintf("not healthy within %v (%s)", check.Timeout, state), lastProbe, info.HealthOutput)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// checkServiceHealth runs the health check against every container of the service after a deploy
+func checkServiceHealth(runner ComposeInspector, project ComposeProject, service string, check HealthCheck) error {
+	quiet := project
+	quiet.Output = nil
+	containers, err := runner.Ps(quiet)
+	if err != nil {
+		return err
+	}
+	checked := 0
+	for _, container := range containers {
+		if container.Service != service {
+			continue
+		}
+		if err := waitForHealthy(runner, project, service, container.ID, check); err != nil {
+			return err
+		}
+		checked++
+	}
+	if checked == 0 {
+		return &HealthCheckError{Service: service, Reason: "no container of the service exists after docker compose up"}
+	}
+	return nil
+}
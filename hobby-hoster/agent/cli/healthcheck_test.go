@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the health check only inspects containers, so it runs against an inspector without any lifecycle operations
+func TestCheckServiceHealthExitedContainer(t *testing.T) {
+	inspector := newFakeComposeInspector()
+	inspector.containers = []ContainerState{{ID: "c1", Name: "app-web-1", Service: "web", Image: "app-web"}}
+	inspector.state = "exited"
+	inspector.exitCode = 2
+
+	err := checkServiceHealth(inspector, newComposeProject("app", nil), "web", HealthCheck{Timeout: time.Second})
+	var healthErr *HealthCheckError
+	if !errors.As(err, &healthErr) || !strings.Contains(healthErr.Reason, "exit code 2") {
+		t.Fatalf("expected the exited container to fail the health check, got %v", err)
+	}
+
+	inspector.state = "running"
+	if err := checkServiceHealth(inspector, newComposeProject("app", nil), "web", HealthCheck{Timeout: time.Second}); err != nil {
+		t.Errorf("expected the running container to pass, got %v", err)
+	}
+}
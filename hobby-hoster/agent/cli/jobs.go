@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var JOBS_DIR = "/mnt/data/jobs"
+
+// JOB_START_TIMEOUT is how long a job may stay queued without a process taking it on
+const JOB_START_TIMEOUT = time.Minute
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+const (
+	JobKindClone   = "clone"
+	JobKindRebuild = "rebuild"
+	JobKindRemove  = "remove"
+	JobKindApply   = "apply"
+)
+
+// rebuildRequest is the input of a rebuild job. It is the JSON the rebuild command takes plus the --parallel flag.
+type rebuildRequest struct {
+	rebuildInput
+	Parallel int `json:"parallel,omitempty"`
+}
+
+type Job struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	State      JobState        `json:"state"`
+	Input      json.RawMessage `json:"input"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	PID        int             `json:"pid,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	// Result holds operation specific data on top of success/error, e.g. the plan of an apply job
+	Result map[string]interface{} `json:"result,omitempty"`
+	Output []CommandRecord        `json:"output"`
+
+	mu sync.Mutex
+}
+
+func (j *Job) Done() bool {
+	return j.State == JobSucceeded || j.State == JobFailed
+}
+
+func getJobPath(id string) string {
+	return filepath.Join(JOBS_DIR, id+".json")
+}
+
+func newJobID() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(random)
+}
+
+func newJob(kind string, input interface{}) (*Job, error) {
+	rawInput, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		ID:        newJobID(),
+		Kind:      kind,
+		State:     JobQueued,
+		Input:     rawInput,
+		CreatedAt: time.Now(),
+		Output:    []CommandRecord{},
+	}
+	if err := job.save(); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// save writes the job record atomically so readers never see a half written file. The lock is held until the
+// record is in place, parallel rebuilds save from several goroutines and an older snapshot mustn't replace a newer one.
+func (j *Job) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getJobPath(j.ID), data, 0644)
+}
+
+func loadJob(id string) (*Job, error) {
+	if strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("invalid job id: %s", id)
+	}
+	data, err := os.ReadFile(getJobPath(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("job %s does not exist", id)
+	} else if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("failed to parse job %s: %v", id, err)
+	}
+	markJobIfOrphaned(job)
+	return job, nil
+}
+
+// markJobIfOrphaned fails a job whose process is gone (e.g. the instance rebooted mid build) or that no process
+// took on, otherwise it would stay "queued" or "running" forever and `jobs wait` would never return.
+func markJobIfOrphaned(job *Job) {
+	if job.Done() {
+		return
+	}
+	var reason string
+	if job.PID != 0 {
+		if err := syscall.Kill(job.PID, 0); err == nil || errors.Is(err, syscall.EPERM) {
+			return
+		}
+		reason = fmt.Sprintf("agent process %d exited before the job finished", job.PID)
+	} else if time.Since(job.CreatedAt) > JOB_START_TIMEOUT {
+		reason = fmt.Sprintf("no agent process started the job within %v", JOB_START_TIMEOUT)
+	} else {
+		return
+	}
+	now := time.Now()
+	job.State = JobFailed
+	job.FinishedAt = &now
+	job.Error = reason
+	job.save()
+}
+
+// pruneJobs deletes the records and logs of jobs that finished longer than retention ago
+func pruneJobs(retention time.Duration) ([]string, error) {
+	jobs, err := listJobs()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-retention)
+	pruned := []string{}
+	for _, job := range jobs {
+		if !job.Done() || job.FinishedAt == nil || job.FinishedAt.After(cutoff) {
+			continue
+		}
+		for _, path := range []string{getJobLinesPath(job.ID), filepath.Join(JOBS_DIR, job.ID+".log"), getJobPath(job.ID)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, job.ID)
+	}
+	return pruned, nil
+}
+
+// runJobPruner prunes old jobs every hour
+func runJobPruner(retention time.Duration) {
+	for {
+		if _, err := pruneJobs(retention); err != nil {
+			log.Printf("Jobs: failed to prune old jobs: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func listJobs() ([]*Job, error) {
+	files, err := os.ReadDir(JOBS_DIR)
+	if os.IsNotExist(err) {
+		return []*Job{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	jobs := []*Job{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		job, err := loadJob(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].CreatedAt.After(jobs[k].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// executeJob runs the operation described by kind and input and returns one error string per failure,
+// along with any operation specific result fields. It is shared by the synchronous and asynchronous
+// code paths so both behave identically.
+func executeJob(kind string, input json.RawMessage, out *OpOutput) (map[string]interface{}, []string) {
+	switch kind {
+	case JobKindRebuild:
+		var req rebuildRequest
+		if err := json.Unmarshal(input, &req); err != nil {
+			return nil, []string{fmt.Sprintf("invalid rebuild input: %v", err)}
+		}
+		results, rebuildErrors := rebuildServices(req.rebuildInput, req.Parallel, out)
+		return map[string]interface{}{"results": results}, rebuildErrors
+	case JobKindClone:
+		var targets []cloneTarget
+		if err := json.Unmarshal(input, &targets); err != nil {
+			return nil, []string{fmt.Sprintf("invalid clone input: %v", err)}
+		}
+		return nil, cloneServices(targets, out)
+	case JobKindRemove:
+		var subdomains []string
+		if err := json.Unmarshal(input, &subdomains); err != nil {
+			return nil, []string{fmt.Sprintf("invalid remove input: %v", err)}
+		}
+		return nil, removeServices(subdomains, out)
+	case JobKindApply:
+		var state DesiredState
+		if err := json.Unmarshal(input, &state); err != nil {
+			return nil, []string{fmt.Sprintf("invalid apply input: %v", err)}
+		}
+		plan, errs := applyDesiredState(state, false, out)
+		return map[string]interface{}{"plan": plan}, errs
+	case JobKindDeploy:
+		var req deployRequest
+		if err := json.Unmarshal(input, &req); err != nil {
+			return nil, []string{fmt.Sprintf("invalid deploy input: %v", err)}
+		}
+		err := executeDeploy(req, out)
+		result := make(map[string]interface{})
+		if warnings, _ := getLabelWarnings(getProjectPath(req.Project.Subdomain)); len(warnings) > 0 {
+			result["warnings"] = warnings
+		}
+		if err != nil {
+			if rollback := rollbackReportOf(err); rollback != nil {
+				result["rollback"] = rollback
+			}
+			return result, []string{fmt.Sprintf("Failed to deploy service %s: %v", req.Project.Subdomain, err)}
+		}
+		return result, nil
+	default:
+		return nil, []string{fmt.Sprintf("unknown job kind: %s", kind)}
+	}
+}
+
+// jobSubdomains returns the projects the operation changes
+func jobSubdomains(kind string, input json.RawMessage) ([]string, error) {
+	var subdomains []string
+	switch kind {
+	case JobKindRebuild:
+		var req rebuildRequest
+		if err := json.Unmarshal(input, &req); err != nil {
+			return nil, fmt.Errorf("invalid rebuild input: %v", err)
+		}
+		for _, subdomain := range req.Subdomains {
+			subdomains = append(subdomains, subdomain.Subdomain)
+		}
+	case JobKindClone:
+		var targets []cloneTarget
+		if err := json.Unmarshal(input, &targets); err != nil {
+			return nil, fmt.Errorf("invalid clone input: %v", err)
+		}
+		for _, target := range targets {
+			subdomains = append(subdomains, target.Subdomain)
+		}
+	case JobKindRemove:
+		if err := json.Unmarshal(input, &subdomains); err != nil {
+			return nil, fmt.Errorf("invalid remove input: %v", err)
+		}
+	case JobKindApply:
+		var state DesiredState
+		if err := json.Unmarshal(input, &state); err != nil {
+			return nil, fmt.Errorf("invalid apply input: %v", err)
+		}
+		return applySubdomains(state)
+	case JobKindDeploy:
+		var req deployRequest
+		if err := json.Unmarshal(input, &req); err != nil {
+			return nil, fmt.Errorf("invalid deploy input: %v", err)
+		}
+		subdomains = append(subdomains, req.Project.Subdomain)
+	}
+	return subdomains, nil
+}
+
+// lockJob blocks until the caller holds the locks of every project the operation changes, see lockProjects
+func lockJob(kind string, input json.RawMessage) (func(), error) {
+	subdomains, err := jobSubdomains(kind, input)
+	if err != nil {
+		return nil, err
+	}
+	return lockProjects(subdomains)
+}
+
+// executeJobLocked is executeJob for the synchronous code paths, which don't go through runJob
+func executeJobLocked(kind string, input json.RawMessage, out *OpOutput) (map[string]interface{}, []string) {
+	unlock, err := lockJob(kind, input)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	defer unlock()
+	return executeJob(kind, input, out)
+}
+
+// resultJSON is the response shape of every operation: the operation's result fields plus "success" or "error"
+func resultJSON(result map[string]interface{}, errs []string) map[string]interface{} {
+	response := map[string]interface{}{}
+	for key, value := range result {
+		response[key] = value
+	}
+	if len(errs) > 0 {
+		response["error"] = strings.Join(errs, "; ")
+	} else {
+		response["success"] = true
+	}
+	return response
+}
+
+func runJob(job *Job) error {
+	writeLine, linesFile, err := jobLinesWriter(job)
+	if err != nil {
+		return err
+	}
+	defer linesFile.Close()
+
+	var out *OpOutput
+	out = NewOpOutput(func() {
+		job.mu.Lock()
+		job.Output = out.Records()
+		job.mu.Unlock()
+		job.save()
+	}).OnLine(writeLine)
+
+	// the job stays queued until no other operation is working on its projects, the PID tells readers it is waiting
+	job.mu.Lock()
+	job.PID = os.Getpid()
+	job.mu.Unlock()
+	if err := job.save(); err != nil {
+		return err
+	}
+	unlock, err := lockJob(job.Kind, job.Input)
+	if err != nil {
+		finishedAt := time.Now()
+		job.mu.Lock()
+		job.State = JobFailed
+		job.FinishedAt = &finishedAt
+		job.Error = err.Error()
+		job.mu.Unlock()
+		job.save()
+		return err
+	}
+	defer unlock()
+
+	startedAt := time.Now()
+	job.mu.Lock()
+	job.State = JobRunning
+	job.StartedAt = &startedAt
+	job.mu.Unlock()
+	if err := job.save(); err != nil {
+		return err
+	}
+
+	result, errs := executeJob(job.Kind, job.Input, out)
+
+	finishedAt := time.Now()
+	job.mu.Lock()
+	job.FinishedAt = &finishedAt
+	job.Output = out.Records()
+	job.Result = result
+	if len(errs) > 0 {
+		job.State = JobFailed
+		job.Error = strings.Join(errs, "; ")
+	} else {
+		job.State = JobSucceeded
+	}
+	job.mu.Unlock()
+	return job.save()
+}
+
+// startJobDetached runs the job in a new session so it survives the SSH session that enqueued it
+func startJobDetached(job *Job) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filepath.Join(JOBS_DIR, job.ID+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(executable, "jobs", "run", job.ID, "--docker-backend", DOCKER_BACKEND)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// enqueueJobFromCLI is used by the --async flag of the clone, rebuild and remove commands
+func enqueueJobFromCLI(cmd *cobra.Command, kind string, input interface{}) error {
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	job, err := newJob(kind, input)
+	if err == nil {
+		err = startJobDetached(job)
+	}
+	if err != nil {
+		if jsonOutput {
+			errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+			fmt.Println(string(errorJson))
+			return nil
+		}
+		return err
+	}
+
+	if jsonOutput {
+		jobJson, _ := json.Marshal(map[string]interface{}{"job_id": job.ID, "state": job.State})
+		fmt.Println(string(jobJson))
+	} else {
+		fmt.Printf("Enqueued %s job %s, follow it with `cli jobs wait %s`\n", kind, job.ID, job.ID)
+	}
+	return nil
+}
+
+func printJob(job *Job) {
+	fmt.Printf("ID:       %s\n", job.ID)
+	fmt.Printf("Kind:     %s\n", job.Kind)
+	fmt.Printf("State:    %s\n", job.State)
+	var input bytes.Buffer
+	json.Compact(&input, job.Input)
+	fmt.Printf("Input:    %s\n", input.String())
+	fmt.Printf("Created:  %s\n", job.CreatedAt.Format(time.RFC3339))
+	if job.StartedAt != nil {
+		fmt.Printf("Started:  %s\n", job.StartedAt.Format(time.RFC3339))
+	}
+	if job.FinishedAt != nil {
+		fmt.Printf("Finished: %s\n", job.FinishedAt.Format(time.RFC3339))
+	}
+	if job.Error != "" {
+		fmt.Printf("Error:    %s\n", job.Error)
+	}
+	for _, record := range job.Output {
+		fmt.Printf("\n[%s] $ %s\n", record.Subdomain, record.Command)
+		if record.Stdout != "" {
+			fmt.Print(record.Stdout)
+		}
+		if record.Stderr != "" {
+			fmt.Print(record.Stderr)
+		}
+		if record.Error != "" {
+			fmt.Printf("error: %s\n", record.Error)
+		}
+	}
+}
+
+func printJobOrError(cmd *cobra.Command, job *Job, err error) error {
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	if err != nil {
+		if jsonOutput {
+			errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+			fmt.Println(string(errorJson))
+			return nil
+		}
+		return err
+	}
+	if jsonOutput {
+		jobJson, _ := json.Marshal(job)
+		fmt.Println(string(jobJson))
+		return nil
+	}
+	printJob(job)
+	return nil
+}
+
+var jobsCmd = &cobra.Command{
+	Use:   "jobs",
+	Short: "Inspect asynchronous jobs",
+	Long:  `This command groups the subcommands used to inspect jobs enqueued with --async.`,
+}
+
+var jobsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List jobs",
+	Long:  `This command lists all jobs, newest first.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobs, err := listJobs()
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		if jsonOutput {
+			jobsJSON, _ := json.Marshal(jobs)
+			fmt.Println(string(jobsJSON))
+		} else {
+			for _, job := range jobs {
+				fmt.Printf("%s\t%s\t%s\t%s\n", job.ID, job.Kind, job.State, job.CreatedAt.Format(time.RFC3339))
+			}
+		}
+		return nil
+	},
+}
+
+var jobsShowCmd = &cobra.Command{
+	Use:   "show [job-id]",
+	Short: "Show a job",
+	Long:  `This command shows the state, timestamps and captured command output of a job.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		job, err := loadJob(args[0])
+		return printJobOrError(cmd, job, err)
+	},
+}
+
+var jobsWaitCmd = &cobra.Command{
+	Use:   "wait [job-id]",
+	Short: "Wait for a job to finish",
+	Long:  `This command blocks until a job has succeeded or failed. Human output streams the job's command output while waiting and ends with the job's state, --json prints the finished job. It exits non zero if the job failed.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		stop := make(chan struct{})
+		if timeout > 0 {
+			time.AfterFunc(timeout, func() { close(stop) })
+		}
+		job, err := followJob(args[0], stop, func(line OutputLine) {
+			if !jsonOutput {
+				fmt.Println(formatOutputLine(line))
+			}
+		})
+		if err == nil && !job.Done() {
+			err = fmt.Errorf("timed out after %v waiting for job %s (state: %s)", timeout, job.ID, job.State)
+		}
+
+		if jsonOutput || err != nil {
+			return printJobOrError(cmd, job, err)
+		}
+		fmt.Printf("Job %s %s\n", job.ID, job.State)
+		if job.State == JobFailed {
+			return fmt.Errorf("job %s failed: %s", job.ID, job.Error)
+		}
+		return nil
+	},
+}
+
+var jobsPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete old jobs",
+	Long:  `This command deletes the records and logs of jobs that finished more than --older-than ago. serve does the same every hour with --job-retention.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		olderThan, _ := cmd.Flags().GetDuration("older-than")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		pruned, err := pruneJobs(olderThan)
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+		if jsonOutput {
+			prunedJson, _ := json.Marshal(map[string]interface{}{"pruned": pruned})
+			fmt.Println(string(prunedJson))
+			return nil
+		}
+		fmt.Printf("Deleted %d jobs\n", len(pruned))
+		return nil
+	},
+}
+
+var jobsRunCmd = &cobra.Command{
+	Use:    "run [job-id]",
+	Short:  "Run a queued job",
+	Long:   `This command runs a queued job in the foreground. It is what --async starts in the background.`,
+	Args:   cobra.ExactArgs(1),
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		job, err := loadJob(args[0])
+		if err != nil {
+			return err
+		}
+		if job.State != JobQueued {
+			return fmt.Errorf("job %s is %s, only queued jobs can be run", job.ID, job.State)
+		}
+		return runJob(job)
+	},
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the hobby-hoster.* labels the agent reads, any other one is most likely a typo and reported as a warning
+var KNOWN_HOBBY_HOSTER_LABELS = []string{
+	"enable", "port", "private", "deploy", "subdomain", "host-prefix",
+	"healthcheck.path", "healthcheck.timeout", "healthcheck.expect-status",
+	"memory", "cpus", "pids",
+}
+
+// parseLabels returns the labels of a service, given either as a list of key=value strings or as a mapping, with
+// variables interpolated from env like compose does. Quotes around a value in the list form are removed.
+func parseLabels(serviceMap map[interface{}]interface{}, env map[string]string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	switch labels := serviceMap["labels"].(type) {
+	case nil:
+	case []interface{}:
+		for _, label := range labels {
+			labelStr, ok := label.(string)
+			if !ok {
+				return nil, fmt.Errorf("label %v is not a string", label)
+			}
+			labelStr, err := interpolate(labelStr, env)
+			if err != nil {
+				return nil, fmt.Errorf("label %s: %v", labelStr, err)
+			}
+			key, val, _ := strings.Cut(labelStr, "=")
+			parsed[strings.TrimSpace(key)] = unquote(strings.TrimSpace(val))
+		}
+	case map[interface{}]interface{}:
+		for key, val := range labels {
+			if val == nil {
+				// a label without a value is set to an empty string
+				parsed[fmt.Sprint(key)] = ""
+				continue
+			}
+			valStr, err := interpolate(fmt.Sprint(val), env)
+			if err != nil {
+				return nil, fmt.Errorf("label %v: %v", key, err)
+			}
+			parsed[fmt.Sprint(key)] = valStr
+		}
+	default:
+		return nil, fmt.Errorf("unsupported label format %T", labels)
+	}
+	return parsed, nil
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+var variableRe = regexp.MustCompile(`\$(\$|[A-Za-z_][A-Za-z0-9_]*|\{[^}]*\}?)`)
+var variableNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+
+// interpolate expands $VAR and ${VAR} in value the way compose does, including the ${VAR:-default}, ${VAR-default},
+// ${VAR:+replacement}, ${VAR+replacement}, ${VAR:?error} and ${VAR?error} forms. $$ is a literal $ and unset variables
+// are empty.
+func interpolate(value string, env map[string]string) (string, error) {
+	var err error
+	expanded := variableRe.ReplaceAllStringFunc(value, func(match string) string {
+		expression := match[1:]
+		if expression == "$" {
+			return "$"
+		}
+		if !strings.HasPrefix(expression, "{") {
+			return env[expression]
+		}
+		if !strings.HasSuffix(expression, "}") {
+			err = fmt.Errorf("unterminated variable %s", match)
+			return match
+		}
+		expression = expression[1 : len(expression)-1]
+		name := variableNameRe.FindString(expression)
+		if name == "" {
+			err = fmt.Errorf("invalid variable %s", match)
+			return match
+		}
+		val, set := env[name]
+		operator, operand := expression[len(name):], ""
+		for _, candidate := range []string{":-", ":+", ":?", "-", "+", "?"} {
+			if strings.HasPrefix(operator, candidate) {
+				operator, operand = candidate, operator[len(candidate):]
+				break
+			}
+		}
+		switch operator {
+		case "":
+			return val
+		case ":-":
+			if val == "" {
+				return operand
+			}
+		case "-":
+			if !set {
+				return operand
+			}
+		case ":+":
+			if val != "" {
+				return operand
+			}
+			return ""
+		case "+":
+			if set {
+				return operand
+			}
+			return ""
+		case ":?", "?":
+			if (operator == ":?" && val == "") || !set {
+				err = fmt.Errorf("required variable %s is missing a value: %s", name, operand)
+			}
+		default:
+			err = fmt.Errorf("invalid variable %s", match)
+		}
+		return val
+	})
+	return expanded, err
+}
+
+// getServiceHobbyHosterLabels returns the hobby-hoster.* labels of one service without the prefix, e.g. port for hobby-hoster.port
+func getServiceHobbyHosterLabels(serviceMap map[interface{}]interface{}, env map[string]string) (map[string]string, error) {
+	labels, err := parseLabels(serviceMap, env)
+	if err != nil {
+		return nil, err
+	}
+	hobbyHosterLabels := make(map[string]string)
+	for key, val := range labels {
+		if strings.HasPrefix(key, "hobby-hoster.") {
+			hobbyHosterLabels[strings.TrimPrefix(key, "hobby-hoster.")] = val
+		}
+	}
+	return hobbyHosterLabels, nil
+}
+
+// getLabelWarnings reports the hobby-hoster.* labels of the project the agent doesn't know
+func getLabelWarnings(fullProjectDir string) ([]string, error) {
+	services, err := getComposeServices(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+	env, err := readDotEnv(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, key := range KNOWN_HOBBY_HOSTER_LABELS {
+		known[key] = true
+	}
+	warnings := []string{}
+	for name, service := range services {
+		serviceMap, ok := service.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		labels, err := getServiceHobbyHosterLabels(serviceMap, env)
+		if err != nil {
+			return nil, fmt.Errorf("service %v: %v", name, err)
+		}
+		for key := range labels {
+			if !known[key] {
+				warnings = append(warnings, fmt.Sprintf("service %v: unknown label hobby-hoster.%s", name, key))
+			}
+		}
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// agent-wide defaults and maximums of the resource limits, set with `cli limits`
+var RESOURCE_LIMITS_FILE = "/mnt/data/resource-limits.json"
+
+// ResourceLimits are the limits of one container, zero means unlimited
+type ResourceLimits struct {
+	MemoryBytes int64   `json:"memory_bytes,omitempty"`
+	CPUs        float64 `json:"cpus,omitempty"`
+	Pids        int64   `json:"pids,omitempty"`
+}
+
+// ResourceLimitsConfig applies to every project: Defaults to services without limits of their own,
+// Max caps what a project can ask for with its labels
+type ResourceLimitsConfig struct {
+	Defaults ResourceLimits `json:"defaults"`
+	Max      ResourceLimits `json:"max"`
+}
+
+func loadResourceLimitsConfig() (ResourceLimitsConfig, error) {
+	var config ResourceLimitsConfig
+	data, err := os.ReadFile(RESOURCE_LIMITS_FILE)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse %s: %v", RESOURCE_LIMITS_FILE, err)
+	}
+	return config, nil
+}
+
+func (c ResourceLimitsConfig) validate() error {
+	if c.Max.MemoryBytes > 0 && c.Defaults.MemoryBytes > c.Max.MemoryBytes {
+		return errors.New("the default memory limit is above the maximum")
+	}
+	if c.Max.CPUs > 0 && c.Defaults.CPUs > c.Max.CPUs {
+		return errors.New("the default cpus limit is above the maximum")
+	}
+	if c.Max.Pids > 0 && c.Defaults.Pids > c.Max.Pids {
+		return errors.New("the default pids limit is above the maximum")
+	}
+	return nil
+}
+
+// parseMemory parses a size the way compose does, e.g. 512m, 1g, 1.5gb or a plain number of bytes
+func parseMemory(val string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(val)), "b")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	size, err := strconv.ParseFloat(s, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid memory size %q, expected a size like 512m or 1g", val)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// formatMemory is the inverse of parseMemory, using the largest unit the size is a whole multiple of
+func formatMemory(bytes int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}} {
+		if bytes >= unit.size && bytes%unit.size == 0 {
+			return fmt.Sprintf("%d%s", bytes/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%db", bytes)
+}
+
+func (l ResourceLimits) String() string {
+	var parts []string
+	if l.MemoryBytes > 0 {
+		parts = append(parts, "memory="+formatMemory(l.MemoryBytes))
+	}
+	if l.CPUs > 0 {
+		parts = append(parts, "cpus="+strconv.FormatFloat(l.CPUs, 'f', -1, 64))
+	}
+	if l.Pids > 0 {
+		parts = append(parts, fmt.Sprintf("pids=%d", l.Pids))
+	}
+	if len(parts) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(parts, " ")
+}
+
+// getProjectLimits reads the hobby-hoster.memory, .cpus and .pids labels and checks them against the agent's maximums
+func getProjectLimits(hobbyHosterMetadata map[string]string, config ResourceLimitsConfig) (ResourceLimits, error) {
+	var limits ResourceLimits
+	var err error
+	if val, ok := hobbyHosterMetadata["memory"]; ok {
+		if limits.MemoryBytes, err = parseMemory(val); err != nil {
+			return limits, fmt.Errorf("invalid hobby-hoster.memory label: %v", err)
+		}
+	}
+	if val, ok := hobbyHosterMetadata["cpus"]; ok {
+		if limits.CPUs, err = strconv.ParseFloat(val, 64); err != nil || limits.CPUs < 0 {
+			return limits, fmt.Errorf("invalid hobby-hoster.cpus label %q, expected a number of CPUs like 0.5", val)
+		}
+	}
+	if val, ok := hobbyHosterMetadata["pids"]; ok {
+		if limits.Pids, err = strconv.ParseInt(val, 10, 64); err != nil || limits.Pids < 0 {
+			return limits, fmt.Errorf("invalid hobby-hoster.pids label %q, expected a number of processes", val)
+		}
+	}
+	return limits, checkMaxLimits("hobby-hoster.* labels", limits, config.Max)
+}
+
+func checkMaxLimits(source string, limits ResourceLimits, max ResourceLimits) error {
+	if max.MemoryBytes > 0 && limits.MemoryBytes > max.MemoryBytes {
+		return fmt.Errorf("memory limit %s of %s is above the agent's maximum of %s", formatMemory(limits.MemoryBytes), source, formatMemory(max.MemoryBytes))
+	}
+	if max.CPUs > 0 && limits.CPUs > max.CPUs {
+		return fmt.Errorf("cpus limit %v of %s is above the agent's maximum of %v", limits.CPUs, source, max.CPUs)
+	}
+	if max.Pids > 0 && limits.Pids > max.Pids {
+		return fmt.Errorf("pids limit %d of %s is above the agent's maximum of %d", limits.Pids, source, max.Pids)
+	}
+	return nil
+}
+
+// serviceLimits reads the limits a service sets itself, either under deploy.resources.limits or with the older
+// mem_limit, cpus and pids_limit keys
+func serviceLimits(serviceMap map[interface{}]interface{}) (ResourceLimits, error) {
+	var limits ResourceLimits
+	values := map[string]interface{}{}
+	for key, name := range map[string]string{"mem_limit": "memory", "cpus": "cpus", "pids_limit": "pids"} {
+		if val, ok := serviceMap[key]; ok {
+			values[name] = val
+		}
+	}
+	if deploy, ok := serviceMap["deploy"].(map[interface{}]interface{}); ok {
+		if resources, ok := deploy["resources"].(map[interface{}]interface{}); ok {
+			if limitsMap, ok := resources["limits"].(map[interface{}]interface{}); ok {
+				for _, name := range []string{"memory", "cpus", "pids"} {
+					if val, ok := limitsMap[name]; ok {
+						values[name] = val
+					}
+				}
+			}
+		}
+	}
+
+	var err error
+	if val, ok := values["memory"]; ok {
+		if limits.MemoryBytes, err = parseMemory(fmt.Sprint(val)); err != nil {
+			return limits, err
+		}
+	}
+	if val, ok := values["cpus"]; ok {
+		if limits.CPUs, err = strconv.ParseFloat(fmt.Sprint(val), 64); err != nil {
+			return limits, fmt.Errorf("invalid cpus %v", val)
+		}
+	}
+	if val, ok := values["pids"]; ok {
+		if limits.Pids, err = strconv.ParseInt(fmt.Sprint(val), 10, 64); err != nil {
+			return limits, fmt.Errorf("invalid pids limit %v", val)
+		}
+	}
+	return limits, nil
+}
+
+// capLimits lowers the limits above the agent's maximums to the maximums and describes every limit it lowered
+func capLimits(limits *ResourceLimits, max ResourceLimits) []string {
+	var capped []string
+	if max.MemoryBytes > 0 && limits.MemoryBytes > max.MemoryBytes {
+		capped = append(capped, fmt.Sprintf("memory limit %s is above the agent's maximum, using %s", formatMemory(limits.MemoryBytes), formatMemory(max.MemoryBytes)))
+		limits.MemoryBytes = max.MemoryBytes
+	}
+	if max.CPUs > 0 && limits.CPUs > max.CPUs {
+		capped = append(capped, fmt.Sprintf("cpus limit %v is above the agent's maximum, using %v", limits.CPUs, max.CPUs))
+		limits.CPUs = max.CPUs
+	}
+	if max.Pids > 0 && limits.Pids > max.Pids {
+		capped = append(capped, fmt.Sprintf("pids limit %d is above the agent's maximum, using %d", limits.Pids, max.Pids))
+		limits.Pids = max.Pids
+	}
+	return capped
+}
+
+// applyResourceLimits sets the effective limits of a service in its compose override: the project's labels win over what
+// the service sets itself, which wins over the agent's defaults. Where none of them set a limit, the maximum is used.
+// The project's labels are checked against the maximums by getProjectLimits, limits the service sets itself (which
+// e.g. come with a compose file written for another host) are capped at them instead, with a warning for each.
+func applyResourceLimits(name string, serviceMap map[interface{}]interface{}, serviceOverride map[interface{}]interface{}, project ResourceLimits, config ResourceLimitsConfig) ([]string, error) {
+	limits, err := serviceLimits(serviceMap)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %v", name, err)
+	}
+	limits.MemoryBytes = firstSet(project.MemoryBytes, limits.MemoryBytes, config.Defaults.MemoryBytes, config.Max.MemoryBytes)
+	limits.CPUs = firstSet(project.CPUs, limits.CPUs, config.Defaults.CPUs, config.Max.CPUs)
+	limits.Pids = firstSet(project.Pids, limits.Pids, config.Defaults.Pids, config.Max.Pids)
+	// the labels and the defaults are within the maximums, a limit above one can only be the service's own
+	var warnings []string
+	for _, capped := range capLimits(&limits, config.Max) {
+		warnings = append(warnings, fmt.Sprintf("service %s: %s", name, capped))
+	}
+
+	limitsMap := make(map[interface{}]interface{})
+	if limits.MemoryBytes > 0 {
+		limitsMap["memory"] = formatMemory(limits.MemoryBytes)
+	}
+	if limits.CPUs > 0 {
+		limitsMap["cpus"] = strconv.FormatFloat(limits.CPUs, 'f', -1, 64)
+	}
+	if limits.Pids > 0 {
+		limitsMap["pids"] = limits.Pids
+	}
+	if len(limitsMap) == 0 {
+		return warnings, nil
+	}
+	serviceOverride["deploy"] = map[interface{}]interface{}{"resources": map[interface{}]interface{}{"limits": limitsMap}}
+
+	// compose refuses different values under deploy.resources.limits and in the legacy keys, which the override
+	// can't remove from the compose file, so the ones the service sets get the same values
+	for key, name := range map[string]string{"mem_limit": "memory", "cpus": "cpus", "pids_limit": "pids"} {
+		if _, ok := serviceMap[key]; ok && limitsMap[name] != nil {
+			serviceOverride[key] = limitsMap[name]
+		}
+	}
+	return warnings, nil
+}
+
+// firstSet returns the first limit that is set, or 0 (unlimited)
+func firstSet[T int64 | float64](values ...T) T {
+	for _, val := range values {
+		if val > 0 {
+			return val
+		}
+	}
+	return 0
+}
+
+// getDeployedLimits returns the limits every service of a deployed project runs with, as written to its compose override
+func getDeployedLimits(fullProjectDir string) (map[string]ResourceLimits, error) {
+	services, err := readDeployedServices(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+	deployed := make(map[string]ResourceLimits)
+	for name, service := range services {
+		serviceMap, ok := service.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		limits, err := serviceLimits(serviceMap)
+		if err != nil {
+			return nil, fmt.Errorf("service %v: %v", name, err)
+		}
+		deployed[fmt.Sprint(name)] = limits
+	}
+	return deployed, nil
+}
+
+var limitsCmd = &cobra.Command{
+	Use:   "limits",
+	Short: "Show or change the default and maximum resource limits",
+	Long:  `This command shows the resource limits every project's services get unless their hobby-hoster.memory, .cpus and .pids labels say otherwise, and the maximums those labels can't exceed. Flags change them for the next deploy, 0 removes a limit.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		printError := func(err error) error {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		config, err := loadResourceLimitsConfig()
+		if err != nil {
+			return printError(err)
+		}
+		changed := false
+		for _, target := range []struct {
+			prefix string
+			limits *ResourceLimits
+		}{{"default", &config.Defaults}, {"max", &config.Max}} {
+			if val, _ := cmd.Flags().GetString(target.prefix + "-memory"); val != "" {
+				if target.limits.MemoryBytes, err = parseMemory(val); err != nil {
+					return printError(err)
+				}
+				changed = true
+			}
+			if val, _ := cmd.Flags().GetString(target.prefix + "-cpus"); val != "" {
+				if target.limits.CPUs, err = strconv.ParseFloat(val, 64); err != nil || target.limits.CPUs < 0 {
+					return printError(fmt.Errorf("invalid --%s-cpus %q", target.prefix, val))
+				}
+				changed = true
+			}
+			if val, _ := cmd.Flags().GetString(target.prefix + "-pids"); val != "" {
+				if target.limits.Pids, err = strconv.ParseInt(val, 10, 64); err != nil || target.limits.Pids < 0 {
+					return printError(fmt.Errorf("invalid --%s-pids %q", target.prefix, val))
+				}
+				changed = true
+			}
+		}
+		if changed {
+			if err := config.validate(); err != nil {
+				return printError(err)
+			}
+			data, _ := json.MarshalIndent(config, "", "  ")
+			if err := writeFileAtomic(RESOURCE_LIMITS_FILE, data, 0644); err != nil {
+				return printError(err)
+			}
+		}
+
+		if jsonOutput {
+			configJson, _ := json.Marshal(config)
+			fmt.Println(string(configJson))
+			return nil
+		}
+		fmt.Printf("%-10s %s\n", "default", config.Defaults)
+		fmt.Printf("%-10s %s\n", "max", config.Max)
+		return nil
+	},
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// a service asking for more than the agent allows is deployed with the maximum instead of failing
+func TestApplyResourceLimitsCapsServiceLimits(t *testing.T) {
+	config := ResourceLimitsConfig{Max: ResourceLimits{MemoryBytes: 512 << 20, CPUs: 1}}
+	serviceMap := map[interface{}]interface{}{
+		"mem_limit": "2g",
+		"deploy":    map[interface{}]interface{}{"resources": map[interface{}]interface{}{"limits": map[interface{}]interface{}{"cpus": "0.5"}}},
+	}
+	serviceOverride := map[interface{}]interface{}{}
+
+	warnings, err := applyResourceLimits("web", serviceMap, serviceOverride, ResourceLimits{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "service web: memory limit 2g is above the agent's maximum") {
+		t.Errorf("expected a warning about the memory limit, got %v", warnings)
+	}
+	limits := serviceOverride["deploy"].(map[interface{}]interface{})["resources"].(map[interface{}]interface{})["limits"].(map[interface{}]interface{})
+	if limits["memory"] != formatMemory(512<<20) || limits["cpus"] != "0.5" {
+		t.Errorf("expected the memory to be capped and the cpus kept, got %v", limits)
+	}
+	if serviceOverride["mem_limit"] != formatMemory(512<<20) {
+		t.Errorf("expected mem_limit to be capped as well, got %v", serviceOverride["mem_limit"])
+	}
+}
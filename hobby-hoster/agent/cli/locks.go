@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+var LOCKS_DIR = "/mnt/data/locks"
+
+// errLocked is returned by the non-blocking locks when another operation holds the lock
+var errLocked = errors.New("locked by another operation")
+
+// fileLock is an exclusive flock on a file. Unlike a sync.Mutex it also keeps out the other agent processes: jobs
+// started with --async, `serve` and one-off commands each run in their own. Every lockFile opens the file anew, so two
+// goroutines of the same process exclude each other too.
+type fileLock struct {
+	file *os.File
+}
+
+func lockFile(path string, wait bool) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) Unlock() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+func getProjectLockPath(subdomain string) (string, error) {
+	if !isValidSubdomain(subdomain) {
+		return "", fmt.Errorf("invalid subdomain: %q", subdomain)
+	}
+	return filepath.Join(LOCKS_DIR, subdomain+".lock"), nil
+}
+
+// lockProjects blocks until the caller holds the lock of every one of the projects, which anything that changes a
+// project (clone, rebuild, deploy, remove) takes first. The locks are taken in order so two operations on overlapping
+// projects can't deadlock. The returned function releases them.
+func lockProjects(subdomains []string) (func(), error) {
+	sorted := append([]string{}, subdomains...)
+	sort.Strings(sorted)
+
+	var locks []*fileLock
+	unlock := func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+	for i, subdomain := range sorted {
+		if i > 0 && sorted[i-1] == subdomain {
+			continue
+		}
+		path, err := getProjectLockPath(subdomain)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		lock, err := lockFile(path, true)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return unlock, nil
+}
+
+// MAX_BUSY_ROUNDS is how many rounds in a row the background loops skip a locked project before logging it
+const MAX_BUSY_ROUNDS = 3
+
+// busyRounds counts the rounds in a row a background loop found a project locked, so a lock that is never released
+// (e.g. by a hung build) shows up in the log rather than quietly keeping the loop away from the project
+type busyRounds struct {
+	loop   string
+	rounds map[string]int
+}
+
+func newBusyRounds(loop string) *busyRounds {
+	return &busyRounds{loop: loop, rounds: make(map[string]int)}
+}
+
+// update records the projects that were skipped this round
+func (b *busyRounds) update(skipped []string) {
+	wasSkipped := make(map[string]bool)
+	for _, subdomain := range skipped {
+		wasSkipped[subdomain] = true
+		b.rounds[subdomain]++
+		if b.rounds[subdomain] > MAX_BUSY_ROUNDS {
+			log.Printf("%s: skipped %s for %d rounds in a row, another operation holds its lock", b.loop, subdomain, b.rounds[subdomain])
+		}
+	}
+	for subdomain := range b.rounds {
+		if !wasSkipped[subdomain] {
+			delete(b.rounds, subdomain)
+		}
+	}
+}
+
+// tryLockProject takes the project's lock unless another operation holds it, in which case it returns errLocked
+func tryLockProject(subdomain string) (*fileLock, error) {
+	path, err := getProjectLockPath(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(path, false)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// LogOptions select the logs of a container, like the flags of `docker logs`
+type LogOptions struct {
+	Follow bool
+	// Since is the zero time for all logs
+	Since time.Time
+	// Tail is the number of lines to show from the end of the logs, -1 for all of them
+	Tail int
+}
+
+// LogLine is a single line a container logged
+type LogLine struct {
+	Timestamp time.Time `json:"timestamp"`
+	Container string    `json:"container"`
+	Service   string    `json:"service"`
+	Stream    string    `json:"stream"`
+	Message   string    `json:"message"`
+}
+
+// parseSince accepts a duration relative to now (e.g. 10m, 24h or 7d), an RFC 3339 time or a date
+func parseSince(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(val); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if days, err := strconv.Atoi(strings.TrimSuffix(val, "d")); err == nil && strings.HasSuffix(val, "d") {
+		return time.Now().AddDate(0, 0, -days), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if since, err := time.Parse(layout, val); err == nil {
+			return since, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q, expected a duration like 24h or 7d, an RFC 3339 time or a date", val)
+}
+
+// parseTail accepts a number of lines or "all"
+func parseTail(val string) (int, error) {
+	if val == "" || val == "all" {
+		return -1, nil
+	}
+	tail, err := strconv.Atoi(val)
+	if err != nil || tail < 0 {
+		return 0, fmt.Errorf("invalid tail %q, expected a number of lines or all", val)
+	}
+	return tail, nil
+}
+
+// newLogLine splits the timestamp docker puts in front of every line off the message
+func newLogLine(container ContainerState, line OutputLine) LogLine {
+	logLine := LogLine{Timestamp: line.Time, Container: container.Name, Service: container.Service, Stream: line.Stream, Message: line.Line}
+	if timestamp, message, found := strings.Cut(line.Line, " "); found {
+		if parsed, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+			logLine.Timestamp = parsed
+			logLine.Message = message
+		}
+	}
+	return logLine
+}
+
+// streamLogs calls emit for the log lines of every container of the project, or of one service when service isn't empty.
+// Without opts.Follow, the lines of all containers are merged in the order they were logged. When following,
+// lines are emitted as they arrive until ctx is done or every container stopped. emit is never called concurrently.
+func streamLogs(ctx context.Context, subdomain string, service string, opts LogOptions, emit func(LogLine)) error {
+	if !isValidSubdomain(subdomain) {
+		return errors.New(fmt.Sprintf("invalid subdomain: %q", subdomain))
+	}
+	if _, err := os.Stat(getProjectPath(subdomain)); os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("Project directory does not exist: %v", err))
+	}
+	runner := getComposeRunner()
+	project := newComposeProject(subdomain, nil)
+	containers, err := runner.Ps(project)
+	if err != nil {
+		return err
+	}
+
+	var selected []ContainerState
+	for _, container := range containers {
+		if service == "" || container.Service == service {
+			selected = append(selected, container)
+		}
+	}
+	if len(selected) == 0 {
+		if service != "" {
+			return fmt.Errorf("no containers of service %s in project %s", service, subdomain)
+		}
+		return fmt.Errorf("no containers in project %s", subdomain)
+	}
+
+	var mu sync.Mutex
+	var collected []LogLine
+	var wg sync.WaitGroup
+	errs := make([]error, len(selected))
+	for i, container := range selected {
+		wg.Add(1)
+		go func(i int, container ContainerState) {
+			defer wg.Done()
+			containerProject := project
+			containerProject.Output = NewOpOutput(nil).OnLine(func(line OutputLine) {
+				logLine := newLogLine(container, line)
+				mu.Lock()
+				defer mu.Unlock()
+				if opts.Follow {
+					emit(logLine)
+				} else {
+					collected = append(collected, logLine)
+				}
+			})
+			errs[i] = runner.ContainerLogs(ctx, containerProject, container.ID, opts)
+		}(i, container)
+	}
+	wg.Wait()
+
+	sort.SliceStable(collected, func(i, k int) bool { return collected[i].Timestamp.Before(collected[k].Timestamp) })
+	for _, line := range collected {
+		emit(line)
+	}
+	return errors.Join(errs...)
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs [subdomain] [service]",
+	Short: "Show the logs of a project's containers",
+	Long:  `This command shows the logs of every container of the project, or of the containers of one service. With --json, every line is printed as a JSON object with its timestamp, container, stream and message.`,
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		follow, _ := cmd.Flags().GetBool("follow")
+		sinceFlag, _ := cmd.Flags().GetString("since")
+		tailFlag, _ := cmd.Flags().GetString("tail")
+		printError := func(err error) error {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		service := ""
+		if len(args) > 1 {
+			service = args[1]
+		}
+		since, err := parseSince(sinceFlag)
+		if err != nil {
+			return printError(err)
+		}
+		tail, err := parseTail(tailFlag)
+		if err != nil {
+			return printError(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err = streamLogs(ctx, args[0], service, LogOptions{Follow: follow, Since: since, Tail: tail}, func(line LogLine) {
+			if jsonOutput {
+				lineJson, _ := json.Marshal(line)
+				fmt.Println(string(lineJson))
+			} else if line.Stream == "stderr" {
+				fmt.Fprintf(os.Stderr, "%s | %s\n", line.Container, line.Message)
+			} else {
+				fmt.Printf("%s | %s\n", line.Container, line.Message)
+			}
+		})
+		if err != nil {
+			return printError(err)
+		}
+		return nil
+	},
+}
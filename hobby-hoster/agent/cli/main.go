@@ -5,35 +5,44 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/spf13/cobra"
-
-	"strconv"
-
-	"gopkg.in/yaml.v2"
 )
 
 var ROOT_PROJECT_DIR = "/mnt/data/projects"
-var LAST_PORT_FILE = "/mnt/data/last-host-port.txt"
 
-var LAST_PORT_MUT = &sync.Mutex{}
+var COMPOSE_REWRITE_MUT = &sync.Mutex{}
 
 func getProjectPath(subdomain string) string {
 	return filepath.Join(ROOT_PROJECT_DIR, subdomain)
 }
 
+var subdomainRe = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// isValidSubdomain guards against subdomains that would escape ROOT_PROJECT_DIR when coming from untrusted input (e.g. the HTTP API)
+func isValidSubdomain(subdomain string) bool {
+	return subdomainRe.MatchString(subdomain)
+}
+
 type CmdWrap struct {
-	cmd    *exec.Cmd
-	stdout bytes.Buffer
-	stderr bytes.Buffer
-	err    error
+	cmd       *exec.Cmd
+	stdout    bytes.Buffer
+	stderr    bytes.Buffer
+	err       error
+	output    *OpOutput
+	subdomain string
+	step      string
 }
 
 func NewCmdWrap(dir string, name string, arg ...string) *CmdWrap {
@@ -43,11 +52,45 @@ func NewCmdWrap(dir string, name string, arg ...string) *CmdWrap {
 	return c
 }
 
+// RecordTo streams the command's output to out line by line while it runs and attaches the full output once it has finished.
+// step names the phase of the operation the command belongs to (e.g. down, build, up).
+func (c *CmdWrap) RecordTo(out *OpOutput, subdomain string, step string) *CmdWrap {
+	c.output = out
+	c.subdomain = subdomain
+	c.step = step
+	return c
+}
+
 func (c *CmdWrap) Run() {
 	c.cmd.Stdout = &c.stdout
 	c.cmd.Stderr = &c.stderr
+	var stdoutLines, stderrLines *lineWriter
+	if c.output != nil {
+		stdoutLines = newLineWriter(c.output, c.subdomain, c.step, "stdout")
+		stderrLines = newLineWriter(c.output, c.subdomain, c.step, "stderr")
+		c.cmd.Stdout = io.MultiWriter(&c.stdout, stdoutLines)
+		c.cmd.Stderr = io.MultiWriter(&c.stderr, stderrLines)
+	}
+	startedAt := time.Now()
 	c.err = c.cmd.Run()
 
+	if c.output != nil {
+		stdoutLines.Flush()
+		stderrLines.Flush()
+		record := CommandRecord{
+			Subdomain:  c.subdomain,
+			Step:       c.step,
+			Command:    c.cmd.String(),
+			Stdout:     c.stdout.String(),
+			Stderr:     c.stderr.String(),
+			StartedAt:  startedAt,
+			FinishedAt: time.Now(),
+		}
+		if c.err != nil {
+			record.Error = c.err.Error()
+		}
+		c.output.Add(record)
+	}
 }
 
 func (c *CmdWrap) Error() error {
@@ -69,8 +112,13 @@ func (c *CmdWrap) ErrorAsJson() string {
 }
 
 type Service struct {
-	Subdomain  string `json:"subdomain"`
+	Subdomain string `json:"subdomain"`
+	// LastCommit is the checked out commit, or the revision of the compose file for projects deployed without a repository
 	LastCommit string `json:"last_commit"`
+	// Images are the images of the last successful deploy, with the digests that were pulled or built
+	Images []DeployedImage `json:"images,omitempty"`
+	// Limits are the resource limits every service runs with, after the project's labels and the agent's defaults and maximums
+	Limits map[string]ResourceLimits `json:"limits,omitempty"`
 }
 
 func listServices() ([]Service, error) {
@@ -84,347 +132,166 @@ func listServices() ([]Service, error) {
 
 	for _, f := range files {
 		if f.IsDir() {
-
-			cmd := exec.Command("git", "-C", projectDir+"/"+f.Name(), "rev-parse", "HEAD")
-			lastCommit, err := cmd.Output()
+			lastCommit, err := getProjectCommit(f.Name())
 			if err != nil {
 				return nil, err
 			}
-			lastCommitString := strings.TrimSpace(string(lastCommit))
-			services = append(services, Service{Subdomain: f.Name(), LastCommit: lastCommitString})
+			service := Service{Subdomain: f.Name(), LastCommit: lastCommit}
+			if release, err := loadRelease(f.Name()); err == nil {
+				service.Images = release.Deployed
+			}
+			if limits, err := getDeployedLimits(getProjectPath(f.Name())); err == nil {
+				service.Limits = limits
+			}
+			services = append(services, service)
 		}
 	}
 
 	return services, nil
 }
 
-func initializePortFile(restartCount bool) error {
-	initialPort := "1024"
-	if _, err := os.Stat(LAST_PORT_FILE); os.IsNotExist(err) {
-		file, err := os.Create(LAST_PORT_FILE)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-
-		// Set initial value to a safe port
-		_, err = file.WriteString(initialPort)
-		if err != nil {
-			return err
-		}
+func getProjectCommit(subdomain string) (string, error) {
+	if revision, err := os.ReadFile(filepath.Join(getProjectPath(subdomain), ".hobby-hoster-revision")); err == nil {
+		return strings.TrimSpace(string(revision)), nil
 	}
-
-	if restartCount {
-		// Reset the port file to the initial port
-		file, err := os.OpenFile(LAST_PORT_FILE, os.O_WRONLY|os.O_TRUNC, 0644)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-
-		_, err = file.WriteString(initialPort)
-		if err != nil {
-			return err
-		}
+	cmd := exec.Command("git", "-C", getProjectPath(subdomain), "rev-parse", "HEAD")
+	lastCommit, err := cmd.Output()
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return strings.TrimSpace(string(lastCommit)), nil
 }
 
-func alterDockerComposeFile(labels []string, fullProjectDir string) error {
-	err := allocatePorts(fullProjectDir)
-
+// alterDockerComposeFile writes the compose override with the host ports, Traefik labels and resource limits of the project.
+// labels maps each routed service to the Traefik labels it gets.
+func alterDockerComposeFile(subdomain string, labels map[string][]string, limits ResourceLimits, fullProjectDir string, out *OpOutput) error {
+	dockerCompose, err := loadComposeModel(fullProjectDir)
 	if err != nil {
 		return err
 	}
+	override := newComposeOverride()
 
-	err = addTraefikToDockerCompose(labels, fullProjectDir)
-
-	return err
-}
-
-func addTraefikToDockerCompose(labels []string, fullProjectDir string) error {
-	dockerComposeFilePath := filepath.Join(fullProjectDir, "docker-compose.yml")
-	if _, err := os.Stat(dockerComposeFilePath); os.IsNotExist(err) {
-		return fmt.Errorf("docker-compose.yml does not exist in project directory: %s", fullProjectDir)
+	err = allocatePorts(subdomain, fullProjectDir, dockerCompose, override)
+	if err != nil {
+		return err
 	}
 
-	input, err := os.ReadFile(dockerComposeFilePath)
+	warnings, err := addTraefikToDockerCompose(labels, limits, dockerCompose, override)
 	if err != nil {
-		return fmt.Errorf("failed to read docker-compose.yml: %v", err)
+		return err
 	}
-
-	var data map[string]interface{}
-	if err := yaml.Unmarshal(input, &data); err != nil {
-		return fmt.Errorf("failed to unmarshal docker-compose.yml: %v", err)
+	sort.Strings(warnings)
+	for _, warning := range warnings {
+		newComposeProject(subdomain, out).logf("limits", "Warning: %s", warning)
 	}
 
-	hobbyHosterEnabledCount := 0
+	return override.write(fullProjectDir)
+}
+
+// addTraefikToDockerCompose adds the labels, networks and resource limits of every service to the override and
+// returns the warnings about limits it had to lower
+func addTraefikToDockerCompose(labels map[string][]string, limits ResourceLimits, dockerCompose map[string]interface{}, override *ComposeOverride) ([]string, error) {
+	services := dockerCompose["services"].(map[interface{}]interface{})
 
-	services, ok := data["services"].(map[interface{}]interface{})
-	if !ok {
-		return errors.New("docker-compose.yml is missing 'services' section")
+	limitsConfig, err := loadResourceLimitsConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	for _, service := range services {
+	var warnings []string
+	for name, service := range services {
 		serviceMap, ok := service.(map[interface{}]interface{})
 		if !ok {
-			return errors.New("failed to assert service as map")
+			return nil, errors.New("failed to assert service as map")
 		}
+		serviceOverride := override.service(fmt.Sprint(name))
 
-		// we need to add the network to all services so they can communicate with each other
-		// TODO find another way instead of forcing all services across all docker compose projects to be on the same network
-		networks, ok := serviceMap["networks"].([]interface{})
-		if ok {
-			if len(networks) != 1 || networks[0] != "traefik-public" {
-				return errors.New("custom networks are not supported for services with 'hobby-hoster.enable=true'")
-			}
-		} else {
-			serviceMap["networks"] = []interface{}{"traefik-public"}
+		// the limits apply to every service, one runaway container shouldn't starve the rest of the instance
+		limitWarnings, err := applyResourceLimits(fmt.Sprint(name), serviceMap, serviceOverride, limits, limitsConfig)
+		if err != nil {
+			return nil, err
 		}
+		warnings = append(warnings, limitWarnings...)
 
-		var labelsSlice []interface{}
-		existingLabels, exists := serviceMap["labels"]
-		if !exists {
-			// no labels
+		// the services of a project talk to each other on its own networks (compose's default one unless it declares
+		// others), only the routed ones are also attached to traefik-public so other projects can't reach the rest
+		serviceLabels, routed := labels[fmt.Sprint(name)]
+		if !routed {
 			continue
 		}
-		switch v := existingLabels.(type) {
-		case []interface{}:
-			labelsSlice = v
+		if _, ok := serviceMap["network_mode"]; ok {
+			return nil, fmt.Errorf("service %v can't set network_mode, Traefik reaches it on the traefik-public network", name)
+		}
+		// compose merges the networks of both files. A service without any is on the default network, which it would
+		// leave once the override names one
+		switch serviceMap["networks"].(type) {
+		case nil:
+			serviceOverride["networks"] = []interface{}{"traefik-public", "default"}
 		case map[interface{}]interface{}:
-			for key, val := range v {
-				labelStr := fmt.Sprintf("%v=%v", key, val)
-				labelsSlice = append(labelsSlice, labelStr)
-			}
+			serviceOverride["networks"] = map[interface{}]interface{}{"traefik-public": nil}
 		default:
-			return errors.New("unsupported label format in docker-compose.yml")
+			serviceOverride["networks"] = []interface{}{"traefik-public"}
 		}
 
-		hobbyHosterEnabled := false
-		// check if hobbyHoster.enable is present in labels:
-		for _, label := range labelsSlice {
-			labelStr, ok := label.(string)
-			if !ok {
-				return errors.New("failed to assert label as string")
-			}
-			if strings.Contains(labelStr, "hobby-hoster.enable=true") {
-				hobbyHosterEnabled = true
-			}
-		}
-
-		if !hobbyHosterEnabled {
-			continue
-		}
-
-		hobbyHosterEnabledCount++
-
-		for _, label := range labels {
-			labelsSlice = append(labelsSlice, label)
-		}
-
-		uniqueLabels := make([]interface{}, 0)
+		// compose merges the labels of both files, on conflicts the ones added here win
+		injectedLabels := make([]interface{}, 0)
 		seen := make(map[string]bool)
-		for _, label := range labelsSlice {
-			labelStr, ok := label.(string)
-			if !ok {
-				return errors.New("non-string label found in docker-compose.yml")
+		for _, label := range serviceLabels {
+			if _, exists := seen[label]; !exists {
+				seen[label] = true
+				injectedLabels = append(injectedLabels, label)
 			}
-			if _, exists := seen[labelStr]; !exists {
-				seen[labelStr] = true
-				uniqueLabels = append(uniqueLabels, labelStr)
-			}
-		}
-		labelsSlice = uniqueLabels
-
-		if hobbyHosterEnabled {
-			serviceMap["labels"] = labelsSlice
 		}
-
-	}
-
-	if hobbyHosterEnabledCount == 0 {
-		return errors.New("No services with 'hobby-hoster.enable=true' found in docker-compose.yml")
-	}
-	if hobbyHosterEnabledCount > 1 {
-		return errors.New("Multiple services with 'hobby-hoster.enable=true' found in docker-compose.yml")
-	} else if hobbyHosterEnabledCount > 1 {
-		return errors.New("multiple services with 'hobby-hoster.enable=true' found in docker-compose.yml")
+		serviceOverride["labels"] = injectedLabels
 	}
 
-	networks, ok := data["networks"].(map[interface{}]interface{})
-	if !ok {
-		networks = make(map[interface{}]interface{})
-		networks["traefik-public"] = map[string]interface{}{
+	// the project's own networks are left as they are, traefik-public is shared by all projects and created by init.sh
+	networks, _ := dockerCompose["networks"].(map[interface{}]interface{})
+	network, declared := networks["traefik-public"]
+	if !declared {
+		override.Networks["traefik-public"] = map[string]interface{}{
 			"external": true,
 		}
-		data["networks"] = networks
-
-	}
-	if len(networks) != 1 {
-		return errors.New("multiple networks are not supported for services with 'hobby-hoster.enable=true'")
-	} else if _, exists := networks["traefik-public"]; !exists {
-		return errors.New("the existing network must be named 'traefik-public'")
+	} else if networkMap, ok := network.(map[interface{}]interface{}); !ok || networkMap["external"] != true {
+		return nil, errors.New("the traefik-public network must be declared as external")
 	}
 
-	// Reordering the map to have 'version', 'services', 'networks' in order
-	orderedData := yaml.MapSlice{}
-
-	// Extracting 'version', 'services', 'networks',"volumes" in the specified order
-	for _, key := range []string{"version", "services", "networks", "volumes", "configs", "secrets"} {
-		if value, ok := data[key]; ok {
-			orderedData = append(orderedData, yaml.MapItem{Key: key, Value: value})
-		}
-	}
-
-	// Marshalling the ordered data instead of the original map
-	output, err := yaml.Marshal(&orderedData)
-	if err != nil {
-		return fmt.Errorf("failed to marshal updated docker-compose.yml with ordered sections: %v", err)
-	}
-
-	if err := os.WriteFile(dockerComposeFilePath, output, 0644); err != nil {
-		return fmt.Errorf("failed to write updated docker-compose.yml: %v", err)
-	}
-
-	return nil
+	return warnings, nil
 }
 
-func allocatePorts(fullProjectDir string) error {
+func allocatePorts(subdomain string, fullProjectDir string, dockerCompose map[string]interface{}, override *ComposeOverride) error {
 	/*
 		since we have many docker compose projects running at the same time, we need to verify that none are using the same host ports.
-		To do this, we modify the host port in place to a known unused port.
+		To do this, the override maps every port to a host port of the port registry instead, which stays the same
+		across rebuilds.
 
-		All possible syntaxes:
-
-		- "3000"
-		- "3000-3005" - NOT SUPPORTED
-		- "8000:8000"
-		- "9090-9091:8080-8081" - NOT SUPPORTED
-		- "49100:22"
-		- "127.0.0.1:8001:8001"
-		- "127.0.0.1:5000-5010:5000-5010" - NOT SUPPORTED
-		- "127.0.0.1::5000"  - NOT SUPPORTED
-		- "6060:6060/udp" - NOT SUPPORTED
-		- "12400-12500:1240" - NOT SUPPORTED
-
-
-		Anything not supported will fail the deploy
+		The short syntax ("3000", "3000-3005", "8000:8000", "9090-9091:8080-8081", "127.0.0.1::5000", "[::1]:8001:8001",
+		"6060:6060/udp", "12400-12500:1240") and the long syntax are both supported, see parsePortMapping. Every entry
+		gets as many contiguous host ports as it has container ports, keeping its host IP and protocol.
 	*/
 
-	LAST_PORT_MUT.Lock()
-	defer LAST_PORT_MUT.Unlock()
-
-	if _, err := os.Stat(LAST_PORT_FILE); os.IsNotExist(err) {
-		file, err := os.Create(LAST_PORT_FILE)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-
-		// Set initial value to a safe port
-		initialPort := "1024"
-		_, err = file.WriteString(initialPort)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Read the last allocated port
-	data, err := os.ReadFile(LAST_PORT_FILE)
-	if err != nil {
-		return err
-	}
-	lastPort, err := strconv.Atoi(string(data))
+	services := dockerCompose["services"].(map[interface{}]interface{})
+	env, err := readDotEnv(fullProjectDir)
 	if err != nil {
 		return err
 	}
-
-	// Parse the docker-compose.yml file
-	data, err = os.ReadFile(fullProjectDir + "/docker-compose.yml")
+	ports, err := portsForServices(services, env)
 	if err != nil {
 		return err
 	}
-	var dockerCompose map[interface{}]interface{}
-	err = yaml.Unmarshal(data, &dockerCompose)
+	hostPorts, err := allocateHostPorts(subdomain, fullProjectDir, ports)
 	if err != nil {
 		return err
 	}
 
-	// Iterate over the services and allocate ports
-	services := dockerCompose["services"].(map[interface{}]interface{})
-	for serviceName, service := range services {
-		serviceMap := service.(map[interface{}]interface{})
-
-		var ports []interface{}
-		if serviceMap["ports"] != nil {
-			ports = serviceMap["ports"].([]interface{})
-		} else {
-			continue
-		}
-		for i, port := range ports {
-			switch p := port.(type) {
-			case int:
-				// same as single port logic
-				lastPort++
-				ports[i] = fmt.Sprintf("%d:%d", lastPort, p)
-			case string: // short syntax
-				// support for   - "3000" format (maps 3000 to 3000):
-				singlePortRe := regexp.MustCompile(`^(\d+)$`)
-				singlePortMatches := singlePortRe.FindStringSubmatch(p)
-				if singlePortMatches != nil {
-					lastPort++
-					ports[i] = fmt.Sprintf("%d:%v", lastPort, port)
-					continue
-				}
-
-				// Match IP address and port
-
-				re := regexp.MustCompile(`^(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}:)?(\d+):(\d+)$`)
-
-				matches := re.FindStringSubmatch(p)
-				if matches == nil {
-					return errors.New("Invalid short port mapping in docker-compose.yml")
-				}
-				lastPort++
-				ports[i] = fmt.Sprintf("%s%d:%s", matches[1], lastPort, matches[3])
-			case map[interface{}]interface{}: // long syntax
-				if target, ok := p["target"].(int); ok {
-					lastPort++
-					p["published"] = lastPort
-					portString := fmt.Sprintf("%d:%d", target, p["published"].(int))
-					re := regexp.MustCompile(`^(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}:)?(\d+):(\d+)$`)
-					matches := re.FindStringSubmatch(portString)
-					if matches == nil {
-						return errors.New("Invalid long port mapping in docker-compose.yml")
-					}
-					ports[i] = map[string]int{"target": target, "published": lastPort}
-				}
-			default:
-				return fmt.Errorf("Unsupported port type: %T", p)
-			}
-
-		}
-		serviceMap["ports"] = ports
-		services[serviceName.(string)] = serviceMap
-	}
-	dockerCompose["services"] = services
-
-	// Write the updated docker-compose.yml file
-	data, err = yaml.Marshal(dockerCompose)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(fullProjectDir+"/docker-compose.yml", data, 0644)
-	if err != nil {
-		return err
+	// the ports are in the order of the compose file, a copy, the ports of the compose file stay as they are
+	overridePorts := make(map[string][]interface{})
+	for i, port := range ports {
+		overridePorts[port.service] = append(overridePorts[port.service], port.mapping.publishedOn(hostPorts[i]))
 	}
-
-	// Update the last allocated port
-	err = os.WriteFile(LAST_PORT_FILE, []byte(strconv.Itoa(lastPort)), 0644)
-	if err != nil {
-		return err
+	for service, ports := range overridePorts {
+		override.service(service)["ports"] = ports
 	}
-
 	return nil
 }
 
@@ -432,6 +299,13 @@ var rootCmd = &cobra.Command{
 	Use:   "cli",
 	Short: "CLI for managing services",
 	Long:  `This is a CLI for managing services.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		switch DOCKER_BACKEND {
+		case "auto", "engine", "cli":
+			return nil
+		}
+		return fmt.Errorf("invalid --docker-backend %q, expected auto, engine or cli", DOCKER_BACKEND)
+	},
 }
 
 var listServicesCmd = &cobra.Command{
@@ -464,207 +338,406 @@ var listServicesCmd = &cobra.Command{
 	},
 }
 
-func getHobbyHosterMetadataFromDockerFile(dockerComposeFilePath string) (map[string]string, error) {
-	data, err := os.ReadFile(dockerComposeFilePath)
+func getHobbyHosterMetadata(fullProjectDir string) (map[string]string, error) {
+	services, err := getComposeServices(fullProjectDir)
 	if err != nil {
 		return nil, err
 	}
 
-	var dockerCompose map[string]interface{}
-	err = yaml.Unmarshal(data, &dockerCompose)
+	env, err := readDotEnv(fullProjectDir)
 	if err != nil {
 		return nil, err
 	}
 
 	hobbyHosterMetadata := make(map[string]string)
 
-	services, ok := dockerCompose["services"].(map[interface{}]interface{})
-	if !ok {
-		return nil, errors.New("invalid docker-compose file format: missing 'services'")
-	}
-
-	for _, service := range services {
+	for name, service := range services {
 		serviceMap, ok := service.(map[interface{}]interface{})
 		if !ok {
 			continue // Not a valid service definition, skip
 		}
 
-		labels, ok := serviceMap["labels"].([]interface{})
-		if !ok {
-			continue // No labels defined, skip
+		labels, err := getServiceHobbyHosterLabels(serviceMap, env)
+		if err != nil {
+			return nil, fmt.Errorf("service %v: %v", name, err)
 		}
-
-		for _, label := range labels {
-			labelStr, ok := label.(string)
-			if !ok {
-				continue // Not a valid label, skip
-			}
-
-			if strings.HasPrefix(labelStr, "hobby-hoster.") {
-				keyValue := strings.SplitN(labelStr, "=", 2)
-				if len(keyValue) == 2 {
-					key := strings.TrimPrefix(keyValue[0], "hobby-hoster.")
-					hobbyHosterMetadata[key] = keyValue[1]
-				}
-			}
+		for key, val := range labels {
+			hobbyHosterMetadata[key] = val
 		}
 	}
 
 	return hobbyHosterMetadata, nil
 }
 
-func rebuildService(domain string, subdomain string, extraTraefikLabels []string) error {
+// rebuildService rebuilds and starts the project, rolling back to the previous release if that fails
+func rebuildService(domain string, subdomain string, extraTraefikLabels []string, out *OpOutput) error {
+	return withRollback(subdomain, out, func() error {
+		return rebuildProject(domain, subdomain, extraTraefikLabels, out)
+	})
+}
+
+func rebuildProject(domain string, subdomain string, extraTraefikLabels []string, out *OpOutput) error {
 	fullProjectDir := getProjectPath(subdomain)
 
 	if _, err := os.Stat(fullProjectDir); os.IsNotExist(err) {
 		return errors.New(fmt.Sprintf("Project directory does not exist: %v", err))
 	}
 
-	cmdDown := NewCmdWrap(fullProjectDir, "docker", "compose", "down")
-	cmdDown.Run()
-	if cmdDown.Error() != nil {
-		// check if compose project is still up, could have just been down or non existent to get to this condition
-		cmdPs := NewCmdWrap(fullProjectDir, "docker", "compose", "ps")
-		cmdPs.Run()
-		if cmdPs.Error() != nil {
-			return fmt.Errorf("Failed to run docker compose ps: %v, original error: %v", cmdPs.Error(), cmdDown.Error())
-		}
+	hobbyHosterMetadata, err := getHobbyHosterMetadata(fullProjectDir)
+	if err != nil {
+		return err
 	}
-	cmdBuild := NewCmdWrap(fullProjectDir, "docker", "compose", "build")
-	cmdBuild.Run()
-	if cmdBuild.Error() != nil {
-		return fmt.Errorf("Failed to run docker compose build: %v", cmdBuild.Error())
+	strategy, err := getDeployStrategy(hobbyHosterMetadata)
+	if err != nil {
+		return err
 	}
 
-	hobbyHosterMetadata, err := getHobbyHosterMetadataFromDockerFile(fullProjectDir + "/docker-compose.yml")
+	limitsConfig, err := loadResourceLimitsConfig()
 	if err != nil {
 		return err
 	}
-
-	port := "80" // Default port
-	if val, ok := hobbyHosterMetadata["port"]; ok {
-		port = val
+	limits, err := getProjectLimits(hobbyHosterMetadata, limitsConfig)
+	if err != nil {
+		return err
 	}
-
-	private := false
-	if val, ok := hobbyHosterMetadata["private"]; ok {
-		private, err = strconv.ParseBool(val)
-		if err != nil {
-			return err
+	routedServices, err := getRoutedServices(fullProjectDir)
+	if err != nil {
+		return err
+	}
+	// every routed service is checked with its own labels, e.g. on its own port
+	healthChecks := make(map[string]HealthCheck)
+	for _, service := range routedServices {
+		if healthChecks[service.Name], err = getHealthCheck(service.Metadata); err != nil {
+			return fmt.Errorf("service %s: %v", service.Name, err)
 		}
 	}
-
-	baseTraefikLabels := []string{
-		"traefik.enable=true",
-		fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s.%s`)", subdomain, subdomain, domain),
-		fmt.Sprintf("traefik.http.routers.%s.entrypoints=websecure", subdomain),
-		fmt.Sprintf("traefik.http.routers.%s.tls=true", subdomain),
-		fmt.Sprintf("traefik.http.routers.%s.tls.certresolver=le", subdomain),
-		fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port=%s", subdomain, port),
+	allLabels, err := getTraefikLabels(domain, subdomain, routedServices, extraTraefikLabels)
+	if err != nil {
+		return err
 	}
 
-	if private {
-		baseTraefikLabels = append(baseTraefikLabels, fmt.Sprintf("traefik.http.routers.%s.middlewares=auth", subdomain))
+	runner := getComposeRunner()
+	project := newComposeProject(subdomain, out)
+	// an older compose would merge the ports of the override with the project's instead of replacing them
+	if err := checkComposeVersion(runner, project); err != nil {
+		return err
 	}
 
-	allLabels := append(baseTraefikLabels, extraTraefikLabels...)
-	err = alterDockerComposeFile(allLabels, fullProjectDir)
+	// the override is written before anything runs, so compose never combines the previous one with a changed compose file.
+	// Rebuilds can run in parallel, writing overrides (which allocates host ports) is done one project at a time
+	COMPOSE_REWRITE_MUT.Lock()
+	err = alterDockerComposeFile(subdomain, allLabels, limits, fullProjectDir, out)
+	COMPOSE_REWRITE_MUT.Unlock()
 	if err != nil {
 		return err
 	}
 
+	if strategy == DeployZeroDowntime {
+		// the running containers are left alone until the new ones are built and up
+		for _, service := range routedServices {
+			if err := checkScalable(service.Name, service.Definition); err != nil {
+				return err
+			}
+		}
+	} else if errDown := runner.Down(project); errDown != nil {
+		// check if compose project is still up, could have just been down or non existent to get to this condition
+		containers, err := runner.Ps(project)
+		if err != nil {
+			return fmt.Errorf("Failed to list containers: %v, original error: %v", err, errDown)
+		}
+		if isProjectRunning(containers) {
+			return fmt.Errorf("%w: %v", errProjectStillRunning, errDown)
+		}
+	}
+	images, builds, err := composeImages(fullProjectDir)
 	if err != nil {
 		return err
 	}
-	cmdUp := NewCmdWrap(fullProjectDir, "docker", "compose", "up", "--detach")
-	cmdUp.Run()
-	if cmdUp.Error() != nil {
-		return errors.New(fmt.Sprintf("Failed to run docker compose up: %v", cmdUp.Error()))
+	// `up` would reuse whatever version of the images of the image-only services is already there
+	if len(images) > 0 {
+		if err := runner.Pull(project); err != nil {
+			return err
+		}
+	}
+	if builds {
+		if err := runner.Build(project); err != nil {
+			return err
+		}
 	}
 
+	if strategy == DeployZeroDowntime {
+		var names []string
+		for _, service := range routedServices {
+			names = append(names, service.Name)
+		}
+		return swapContainers(runner, project, names, healthChecks)
+	}
+	if err := runner.Up(project); err != nil {
+		return err
+	}
+	for _, service := range routedServices {
+		if err := checkServiceHealth(runner, project, service.Name, healthChecks[service.Name]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func removeService(subdomain string) error {
+func removeService(subdomain string, out *OpOutput) error {
 	fullProjectDir := getProjectPath(subdomain)
 	if _, err := os.Stat(fullProjectDir); os.IsNotExist(err) {
 		return errors.New(fmt.Sprintf("Project directory does not exist: %v", err))
 	}
-	cmdDown := exec.Command("docker", "compose", "down")
-	cmdDown.Dir = fullProjectDir
-	err := cmdDown.Run()
-	if err != nil {
-		return errors.New(fmt.Sprintf("Failed to run docker compose down: %v", err))
+	runner := getComposeRunner()
+	project := newComposeProject(subdomain, out)
+	if err := runner.Down(project); err != nil {
+		return err
 	}
 
-	err = os.RemoveAll(fullProjectDir)
+	err := os.RemoveAll(fullProjectDir)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Failed to remove directory %s: %v", fullProjectDir, err))
 	}
+	if err := removeRelease(runner, project); err != nil {
+		return errors.New(fmt.Sprintf("Failed to remove the saved release: %v", err))
+	}
+	if err := releasePorts(subdomain); err != nil {
+		return errors.New(fmt.Sprintf("Failed to release the host ports: %v", err))
+	}
 
 	return nil
 }
 
+type rebuildSubdomain struct {
+	Subdomain          string   `json:"subdomain"`
+	ExtraTraefikLabels []string `json:"extra_traefik_labels"`
+}
+
+type rebuildInput struct {
+	Domain     string             `json:"domain"`
+	Subdomains []rebuildSubdomain `json:"subdomains"`
+}
+
+// RebuildResult is the outcome of rebuilding one subdomain
+type RebuildResult struct {
+	Subdomain  string    `json:"subdomain"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DurationMs int64     `json:"duration_ms"`
+	// Rollback is set when the rebuild failed and the previous release was restored
+	Rollback *RollbackReport `json:"rollback,omitempty"`
+	// Warnings lists the hobby-hoster.* labels of the project the agent doesn't know, which are most likely typos
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// rebuildServices rebuilds every subdomain in the input, up to parallel at a time, and returns the results in input order
+// along with one error string per failed subdomain.
+func rebuildServices(input rebuildInput, parallel int, out *OpOutput) ([]RebuildResult, []string) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	results := make([]RebuildResult, len(input.Subdomains))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, subdomain := range input.Subdomains {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, subdomain rebuildSubdomain) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			result := RebuildResult{Subdomain: subdomain.Subdomain, StartedAt: time.Now()}
+			// a project whose labels can't be read fails the rebuild with the same error
+			result.Warnings, _ = getLabelWarnings(getProjectPath(subdomain.Subdomain))
+			err := rebuildService(input.Domain, subdomain.Subdomain, subdomain.ExtraTraefikLabels, out)
+			result.FinishedAt = time.Now()
+			result.DurationMs = result.FinishedAt.Sub(result.StartedAt).Milliseconds()
+			if err != nil {
+				result.Error = err.Error()
+				result.Rollback = rollbackReportOf(err)
+			} else {
+				result.Success = true
+			}
+			results[i] = result
+		}(i, subdomain)
+	}
+	wg.Wait()
+
+	var rebuildErrors []string
+	for _, result := range results {
+		if !result.Success {
+			rebuildErrors = append(rebuildErrors, fmt.Sprintf("Failed to rebuild service %v repository: %v", result.Subdomain, result.Error))
+		}
+	}
+	return results, rebuildErrors
+}
+
+func printRebuildResults(results []RebuildResult) {
+	for _, result := range results {
+		status := "ok"
+		if result.Rollback != nil && result.Rollback.Success {
+			status = "rolled back to " + shortCommit(result.Rollback.Commit)
+		} else if !result.Success {
+			status = "failed"
+		}
+		fmt.Printf("%-20s %-7s %s\n", result.Subdomain, status, (time.Duration(result.DurationMs) * time.Millisecond).String())
+		for _, warning := range result.Warnings {
+			fmt.Printf("  warning: %s\n", warning)
+		}
+	}
+}
+
+type cloneTarget struct {
+	Repo      string `json:"repo"`
+	Subdomain string `json:"subdomain"`
+	// Branch is optional, the remote's default branch is cloned when it is empty
+	Branch string `json:"branch,omitempty"`
+	// Commit is optional, the branch head is checked out when it is empty
+	Commit string `json:"commit,omitempty"`
+}
+
+func cloneService(target cloneTarget, out *OpOutput) error {
+	repo := target.Repo
+	subdomain := target.Subdomain
+	fullProjectDir := getProjectPath(subdomain)
+
+	if _, err := os.Stat(fullProjectDir); !os.IsNotExist(err) {
+		err := os.RemoveAll(fullProjectDir)
+		if err != nil {
+			return fmt.Errorf("Failed to remove existing directory %s: %v", fullProjectDir, err)
+		}
+	}
+
+	var progress bytes.Buffer
+	progressLines := newLineWriter(out, subdomain, "clone", "stdout")
+	startedAt := time.Now()
+	cloneOptions := &git.CloneOptions{
+		URL:      repo,
+		Depth:    1,
+		Progress: io.MultiWriter(&progress, progressLines),
+	}
+	command := fmt.Sprintf("git clone --depth 1 %s %s", repo, fullProjectDir)
+	if target.Branch != "" {
+		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(target.Branch)
+		cloneOptions.SingleBranch = true
+		command = fmt.Sprintf("git clone --depth 1 --branch %s %s %s", target.Branch, repo, fullProjectDir)
+	}
+	if target.Commit != "" {
+		// the commit can be behind the branch head, so the whole history is fetched
+		cloneOptions.Depth = 0
+		command = strings.Replace(command, "--depth 1 ", "", 1) + " && git checkout " + target.Commit
+	}
+	repository, err := git.PlainClone(fullProjectDir, false, cloneOptions)
+	if err == nil && target.Commit != "" {
+		err = checkoutCommit(repository, target.Commit)
+	}
+	progressLines.Flush()
+	record := CommandRecord{
+		Subdomain:  subdomain,
+		Step:       "clone",
+		Command:    command,
+		Stdout:     progress.String(),
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	out.Add(record)
+	if err != nil {
+		return fmt.Errorf("Failed to clone repository %s: %v", repo, err)
+	}
+
+	if _, err := getComposeFiles(fullProjectDir); err != nil {
+		return fmt.Errorf("no usable compose file in the cloned repository %s: %v", repo, err)
+	}
+	return nil
+}
+
+func checkoutCommit(repository *git.Repository, commit string) error {
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := worktree.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(commit)}); err != nil {
+		return fmt.Errorf("failed to check out %s: %v", commit, err)
+	}
+	return nil
+}
+
+func cloneServices(targets []cloneTarget, out *OpOutput) []string {
+	var errs []string
+	for _, target := range targets {
+		if err := cloneService(target, out); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return errs
+}
+
+func removeServices(subdomains []string, out *OpOutput) []string {
+	var errs []string
+	for _, subdomain := range subdomains {
+		err := removeService(subdomain, out)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Failed to remove service %s: %v", subdomain, err))
+			continue
+		}
+	}
+	return errs
+}
+
 var rebuildCmd = &cobra.Command{
 	Use:   `rebuild --json '{"domain":"example.com","subdomains":[{"subdomain":"sub1","extra_traefik_labels":["label1"]},{"subdomain":"sub2","extra_traefik_labels":["label2"]}]}'`,
 	Short: "Rebuild services",
 	Long:  `This command rebuilds all services based on a JSON input. The JSON should specify the domain, subdomains, and any extra Traefik labels for each subdomain.`,
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var input struct {
-			Domain     string `json:"domain"`
-			Subdomains []struct {
-				Subdomain          string   `json:"subdomain"`
-				ExtraTraefikLabels []string `json:"extra_traefik_labels"`
-			} `json:"subdomains"`
-		}
+		var input rebuildInput
 
 		if err := json.Unmarshal([]byte(args[0]), &input); err != nil {
 			return err
 		}
 
-		domain := input.Domain
-		var rebuildErrors []string
 		jsonOutput, _ := cmd.Flags().GetBool("json")
 
-		all, err := cmd.Flags().GetBool("all")
-		if err != nil {
-			return errors.New(fmt.Sprintf("Failed to get 'all' flag: %v", err))
-		}
+		parallel, _ := cmd.Flags().GetInt("parallel")
 
-		if all {
-			// take this opportunity to reset the port file
-			err := initializePortFile(true)
-			if err != nil {
-				if jsonOutput {
-					errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
-					fmt.Println(string(errorJson))
-					return nil
-				} else {
-					return err
-				}
-			}
+		if async, _ := cmd.Flags().GetBool("async"); async {
+			return enqueueJobFromCLI(cmd, JobKindRebuild, rebuildRequest{rebuildInput: input, Parallel: parallel})
 		}
 
+		var subdomains []string
 		for _, subdomain := range input.Subdomains {
-			err := rebuildService(domain, subdomain.Subdomain, subdomain.ExtraTraefikLabels)
-			if err != nil {
-				rebuildErrors = append(rebuildErrors, fmt.Sprintf("Failed to rebuild service %v repository: %v", subdomain, err))
-				continue
-			}
+			subdomains = append(subdomains, subdomain.Subdomain)
+		}
+		unlock, err := lockProjects(subdomains)
+		if err != nil {
+			return err
 		}
+		results, rebuildErrors := rebuildServices(input, parallel, newCLIOutput(cmd))
+		unlock()
 
-		if len(rebuildErrors) > 0 {
-			if jsonOutput {
+		if jsonOutput && cmd.Flags().Changed("parallel") {
+			resultJson, _ := json.Marshal(resultJSON(map[string]interface{}{"results": results}, rebuildErrors))
+			fmt.Println(string(resultJson))
+			return nil
+		} else if jsonOutput {
+			// without --parallel the output stays what scripts parsing it have always gotten
+			if len(rebuildErrors) > 0 {
 				jsonErrors, _ := json.Marshal(map[string]interface{}{"error": strings.Join(rebuildErrors, "; ")})
 				fmt.Println(string(jsonErrors))
-				return nil
 			} else {
-				return errors.New(fmt.Sprintf("Encountered errors during rebuilding: %v", strings.Join(rebuildErrors, "; ")))
+				fmt.Println(`{"success": true}`)
 			}
+			return nil
 		}
-		if jsonOutput {
-			fmt.Println(`{"success": true}`)
+		printRebuildResults(results)
+		if len(rebuildErrors) > 0 {
+			return errors.New(fmt.Sprintf("Encountered errors during rebuilding: %v", strings.Join(rebuildErrors, "; ")))
 		}
 		return nil
 	},
@@ -674,34 +747,33 @@ var cloneCmd = &cobra.Command{
 	Use:   "clone [repo-url] [subdomain]...",
 	Short: "Clone GitHub repositories",
 	Long:  `This command clones multiple GitHub repositories to specific directories and commits.`,
-	Args:  cobra.MinimumNArgs(2),
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := cobra.MinimumNArgs(2)(cmd, args); err != nil {
+			return err
+		}
+		if len(args)%2 != 0 {
+			return fmt.Errorf("expected pairs of repo-url and subdomain, %s has no subdomain", args[len(args)-1])
+		}
+		return nil
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var errs []string
+		var targets []cloneTarget
 		for i := 0; i < len(args); i += 2 {
-			repo := args[i]
-			subdomain := args[i+1]
-			fullProjectDir := getProjectPath(subdomain)
-
-			if _, err := os.Stat(fullProjectDir); !os.IsNotExist(err) {
-				err := os.RemoveAll(fullProjectDir)
-				if err != nil {
-					errs = append(errs, fmt.Sprintf("Failed to remove existing directory %s: %v", fullProjectDir, err))
-					continue
-				}
-			}
-
-			_, err := git.PlainClone(fullProjectDir, false, &git.CloneOptions{
-				URL:   repo,
-				Depth: 1,
-			})
-			if err != nil {
-				errs = append(errs, fmt.Sprintf("Failed to clone repository %s: %v", repo, err))
-				continue
-			}
-
-			if _, err := os.Stat(fullProjectDir + "/docker-compose.yml"); os.IsNotExist(err) {
-				errs = append(errs, fmt.Sprintf("docker-compose.yml does not exist in the root of the cloned repository %s", repo))
-			}
+			targets = append(targets, cloneTarget{Repo: args[i], Subdomain: args[i+1]})
+		}
+		if async, _ := cmd.Flags().GetBool("async"); async {
+			return enqueueJobFromCLI(cmd, JobKindClone, targets)
+		}
+		var subdomains []string
+		for _, target := range targets {
+			subdomains = append(subdomains, target.Subdomain)
+		}
+		var errs []string
+		if unlock, err := lockProjects(subdomains); err != nil {
+			errs = []string{err.Error()}
+		} else {
+			errs = cloneServices(targets, newCLIOutput(cmd))
+			unlock()
 		}
 
 		jsonOutput, _ := cmd.Flags().GetBool("json")
@@ -726,13 +798,15 @@ var removeServicesCmd = &cobra.Command{
 	Long:  `This command removes one or more services by their subdomains.`,
 	Args:  cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if async, _ := cmd.Flags().GetBool("async"); async {
+			return enqueueJobFromCLI(cmd, JobKindRemove, args)
+		}
 		var errs []string
-		for _, subdomain := range args {
-			err := removeService(subdomain)
-			if err != nil {
-				errs = append(errs, fmt.Sprintf("Failed to remove service %s: %v", subdomain, err))
-				continue
-			}
+		if unlock, err := lockProjects(args); err != nil {
+			errs = []string{err.Error()}
+		} else {
+			errs = removeServices(args, newCLIOutput(cmd))
+			unlock()
 		}
 
 		jsonOutput, _ := cmd.Flags().GetBool("json")
@@ -755,12 +829,72 @@ var removeServicesCmd = &cobra.Command{
 
 func main() {
 	rootCmd.PersistentFlags().Bool("json", false, "Output in JSON format")
+	rootCmd.PersistentFlags().StringVar(&DOCKER_BACKEND, "docker-backend", "auto", "How containers are managed: engine (Docker Engine API on "+DOCKER_SOCKET+"), cli (docker compose) or auto (engine when the socket answers)")
 	rebuildCmd.Flags().Bool("all", false, "Rebuild all services")
+	rebuildCmd.Flags().MarkDeprecated("all", "it only reset the host port counter, host ports are now kept across rebuilds")
+	rebuildCmd.Flags().Int("parallel", 1, "Rebuild up to this many services at the same time")
+	applyCmd.Flags().Bool("dry-run", false, "Only print the plan")
+	applyCmd.Flags().Bool("force-rebuild", false, "Rebuild every project even if its commit did not change")
+	for _, c := range []*cobra.Command{cloneCmd, rebuildCmd, removeServicesCmd, applyCmd} {
+		c.Flags().Bool("async", false, "Enqueue the operation as a job and return its ID instead of waiting for it")
+		c.Flags().Bool("stream", false, "With --json, print command output as JSON lines while it runs (human output always streams)")
+	}
+	pollsCmd.Flags().Bool("history", false, "Show every recorded poll instead of only the last one")
+	webhookSecretCmd.Flags().Bool("rotate", false, "Generate a new secret")
+	driftCmd.Flags().Bool("repair", false, "Repair drifted projects whose drift_policy is \"repair\"")
+	driftCmd.Flags().Bool("last", false, "Show the report of the last background reconciler run")
+	jobsWaitCmd.Flags().Duration("timeout", 0, "Give up waiting after this long (0 waits forever)")
+	jobsPruneCmd.Flags().Duration("older-than", 7*24*time.Hour, "Delete jobs that finished longer ago than this")
+	serveCmd.Flags().String("listen", "127.0.0.1:7070", "Address the management API listens on")
+	serveCmd.Flags().Duration("reconcile-interval", 0, "Check for drift from the desired state this often, repairing projects with drift_policy \"repair\" (0 disables the reconciler)")
+	serveCmd.Flags().Duration("webhook-debounce", 10*time.Second, "Wait this long after the last push to a project before deploying it")
+	serveCmd.Flags().Duration("webhook-max-age", 10*time.Minute, "Reject webhook deliveries for pushes older than this (0 disables the check)")
+	serveCmd.Flags().Duration("usage-interval", time.Minute, "Sample the resource usage of every project this often (0 disables sampling)")
+	serveCmd.Flags().Duration("usage-retention", 7*24*time.Hour, "Keep usage samples for this long")
+	serveCmd.Flags().Duration("job-retention", 7*24*time.Hour, "Delete jobs that finished longer ago than this (0 keeps them)")
+	serveCmd.Flags().Duration("gc-interval", 0, "Remove old images and build cache this often (0 disables the garbage collector)")
+	serveCmd.Flags().Int("gc-keep", 3, "Number of most recent images the garbage collector keeps per service")
+	serveCmd.Flags().String("gc-build-cache-budget", "5g", "Build cache the garbage collector leaves behind, e.g. 5g, or none to leave it alone")
+	serveCmd.Flags().String("token", "", "Bearer token required by the management API (defaults to $HOBBY_HOSTER_AGENT_TOKEN)")
 
 	rootCmd.AddCommand(cloneCmd)
 	rootCmd.AddCommand(listServicesCmd)
 	rootCmd.AddCommand(removeServicesCmd)
 	rootCmd.AddCommand(rebuildCmd)
+	rootCmd.AddCommand(applyCmd)
+	rootCmd.AddCommand(driftCmd)
+	rootCmd.AddCommand(webhookSecretCmd)
+	rootCmd.AddCommand(pollsCmd)
+	registryLoginCmd.Flags().String("username", "", "Registry username")
+	registryCmd.AddCommand(registryLoginCmd)
+	registryCmd.AddCommand(registryLogoutCmd)
+	registryCmd.AddCommand(registryListCmd)
+	rootCmd.AddCommand(registryCmd)
+	for _, prefix := range []string{"default", "max"} {
+		limitsCmd.Flags().String(prefix+"-memory", "", "Set the "+prefix+" memory limit of a container, e.g. 512m")
+		limitsCmd.Flags().String(prefix+"-cpus", "", "Set the "+prefix+" number of CPUs of a container, e.g. 0.5")
+		limitsCmd.Flags().String(prefix+"-pids", "", "Set the "+prefix+" number of processes of a container")
+	}
+	rootCmd.AddCommand(limitsCmd)
+	logsCmd.Flags().BoolP("follow", "f", false, "Keep printing new lines until interrupted")
+	logsCmd.Flags().String("since", "", "Only show lines logged since a time (RFC 3339 or a date) or for a duration (e.g. 10m)")
+	logsCmd.Flags().String("tail", "all", "Number of lines to show from the end of each container's logs")
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(portsCmd)
+	usageCmd.Flags().String("since", "24h", "Summarize the usage since a time (RFC 3339 or a date) or for a duration (e.g. 24h or 7d)")
+	rootCmd.AddCommand(usageCmd)
+	gcCmd.Flags().Int("keep", 3, "Number of most recent images to keep per service")
+	gcCmd.Flags().String("build-cache-budget", "5g", "Build cache to leave behind, e.g. 5g, or none to leave it alone")
+	gcCmd.Flags().Bool("dry-run", false, "Only report what would be removed")
+	rootCmd.AddCommand(gcCmd)
+	rootCmd.AddCommand(serveCmd)
+	jobsCmd.AddCommand(jobsListCmd)
+	jobsCmd.AddCommand(jobsShowCmd)
+	jobsCmd.AddCommand(jobsWaitCmd)
+	jobsCmd.AddCommand(jobsPruneCmd)
+	jobsCmd.AddCommand(jobsRunCmd)
+	rootCmd.AddCommand(jobsCmd)
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandRecord is the captured result of one command run on behalf of an operation.
+type CommandRecord struct {
+	Subdomain  string    `json:"subdomain,omitempty"`
+	Step       string    `json:"step,omitempty"`
+	Command    string    `json:"command"`
+	Stdout     string    `json:"stdout"`
+	Stderr     string    `json:"stderr"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// OutputLine is a single line of command output, emitted as soon as the command prints it.
+type OutputLine struct {
+	Time      time.Time `json:"time"`
+	Subdomain string    `json:"subdomain,omitempty"`
+	Step      string    `json:"step"`
+	Stream    string    `json:"stream"`
+	Line      string    `json:"line"`
+}
+
+// OpOutput collects the output of every command run during an operation (e.g. a job).
+// A nil *OpOutput is valid and discards everything, which is what the synchronous CLI commands use.
+type OpOutput struct {
+	mu       sync.Mutex
+	records  []CommandRecord
+	onRecord func()
+
+	lineMu       sync.Mutex
+	lineHandlers []func(OutputLine)
+}
+
+func NewOpOutput(onRecord func()) *OpOutput {
+	return &OpOutput{onRecord: onRecord}
+}
+
+// OnLine registers a handler that is called for every line of output while commands are still running.
+// Handlers are never called concurrently.
+func (o *OpOutput) OnLine(handler func(OutputLine)) *OpOutput {
+	o.lineMu.Lock()
+	o.lineHandlers = append(o.lineHandlers, handler)
+	o.lineMu.Unlock()
+	return o
+}
+
+func (o *OpOutput) Add(record CommandRecord) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	o.records = append(o.records, record)
+	o.mu.Unlock()
+	if o.onRecord != nil {
+		o.onRecord()
+	}
+}
+
+func (o *OpOutput) Line(line OutputLine) {
+	if o == nil {
+		return
+	}
+	o.lineMu.Lock()
+	defer o.lineMu.Unlock()
+	for _, handler := range o.lineHandlers {
+		handler(line)
+	}
+}
+
+func (o *OpOutput) Records() []CommandRecord {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]CommandRecord{}, o.records...)
+}
+
+// lineWriter splits whatever a command writes into lines and forwards them to an OpOutput.
+// Carriage returns are treated as line breaks too since progress output (e.g. git) uses them to redraw a line.
+type lineWriter struct {
+	out       *OpOutput
+	subdomain string
+	step      string
+	stream    string
+	buf       []byte
+}
+
+func newLineWriter(out *OpOutput, subdomain string, step string, stream string) *lineWriter {
+	return &lineWriter{out: out, subdomain: subdomain, step: step, stream: stream}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.emit(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits a trailing line that was not terminated by a newline
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emit(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	w.out.Line(OutputLine{Time: time.Now(), Subdomain: w.subdomain, Step: w.step, Stream: w.stream, Line: line})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the agent leaves the project's compose file as it is in the repository, everything it adds (Traefik labels, the
+// network, host port remaps and resource limits) goes into this override, which is passed to compose after it
+const COMPOSE_OVERRIDE_FILE = "docker-compose.hobby-hoster.yml"
+
+// composeFileArgs lists the compose files of the project for `docker compose`, see getComposeFiles. Naming them turns
+// off compose's own lookup of the override file and COMPOSE_FILE, so they are passed explicitly.
+func composeFileArgs(fullProjectDir string) []string {
+	if _, err := os.Stat(filepath.Join(fullProjectDir, COMPOSE_OVERRIDE_FILE)); err != nil {
+		// not deployed yet, compose finds the files itself
+		return nil
+	}
+	files, err := getComposeFiles(fullProjectDir)
+	if err != nil {
+		// compose reports the problem when it can't find the files either
+		return nil
+	}
+	var args []string
+	for _, file := range files {
+		args = append(args, "-f", file)
+	}
+	return append(args, "-f", COMPOSE_OVERRIDE_FILE)
+}
+
+// readComposeFile parses a compose file, making sure it has services
+func readComposeFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var dockerCompose map[string]interface{}
+	if err := yaml.Unmarshal(data, &dockerCompose); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %v", filepath.Base(path), err)
+	}
+	if _, ok := dockerCompose["services"].(map[interface{}]interface{}); !ok {
+		return nil, fmt.Errorf("%s is missing 'services' section", filepath.Base(path))
+	}
+	return dockerCompose, nil
+}
+
+// readComposeServices returns the services section of a compose file
+func readComposeServices(path string) (map[interface{}]interface{}, error) {
+	dockerCompose, err := readComposeFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return dockerCompose["services"].(map[interface{}]interface{}), nil
+}
+
+// ComposeOverride is what the agent adds to a project's compose file
+type ComposeOverride struct {
+	Services map[string]map[interface{}]interface{}
+	Networks map[interface{}]interface{}
+}
+
+func newComposeOverride() *ComposeOverride {
+	return &ComposeOverride{Services: make(map[string]map[interface{}]interface{}), Networks: make(map[interface{}]interface{})}
+}
+
+// service returns the override of a service, creating it the first time
+func (o *ComposeOverride) service(name string) map[interface{}]interface{} {
+	if _, ok := o.Services[name]; !ok {
+		o.Services[name] = make(map[interface{}]interface{})
+	}
+	return o.Services[name]
+}
+
+// compose merges the ports of all files, !override makes the remapped ports replace the ones of the project. yaml.v2
+// can't emit tags, so write marshals this placeholder (numbered per service) as the ports of each service and then
+// replaces it with the tagged ports. The trailing dash keeps placeholder 1 from matching the start of placeholder 10.
+const OVERRIDE_PLACEHOLDER = "hobby-hoster-override-%d-"
+
+// MIN_COMPOSE_VERSION is the first Docker Compose release that understands !override
+var MIN_COMPOSE_VERSION = []int{2, 24, 4}
+
+// checkComposeVersion fails when the Docker Compose the runner deploys with is too old for the override
+func checkComposeVersion(runner ComposeLifecycle, project ComposeProject) error {
+	version, err := runner.ComposeVersion(project)
+	if err != nil {
+		return fmt.Errorf("failed to get the Docker Compose version: %v", err)
+	}
+	version = strings.TrimPrefix(version, "v")
+	// e.g. 2.24.6-desktop.1
+	version, _, _ = strings.Cut(version, "-")
+	parts := strings.Split(version, ".")
+	for i, minimum := range MIN_COMPOSE_VERSION {
+		part := 0
+		if i < len(parts) {
+			if part, err = strconv.Atoi(parts[i]); err != nil {
+				return fmt.Errorf("unexpected Docker Compose version %q", version)
+			}
+		}
+		if part != minimum {
+			if part < minimum {
+				return fmt.Errorf("Docker Compose %s is installed, deploying needs 2.24.4 or newer", version)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (o *ComposeOverride) write(fullProjectDir string) error {
+	services := make(map[string]map[interface{}]interface{})
+	var taggedPorts [][]byte
+	for name, service := range o.Services {
+		services[name] = make(map[interface{}]interface{})
+		for key, value := range service {
+			services[name][key] = value
+		}
+		if ports, ok := service["ports"]; ok {
+			// JSON is YAML in flow style, which keeps the ports on the line of the placeholder whatever they contain
+			tagged, err := json.Marshal(jsonValue(ports))
+			if err != nil {
+				return fmt.Errorf("failed to marshal the ports of %s: %v", name, err)
+			}
+			services[name]["ports"] = fmt.Sprintf(OVERRIDE_PLACEHOLDER, len(taggedPorts))
+			taggedPorts = append(taggedPorts, append([]byte("!override "), tagged...))
+		}
+	}
+
+	data := yaml.MapSlice{{Key: "services", Value: services}}
+	if len(o.Networks) > 0 {
+		data = append(data, yaml.MapItem{Key: "networks", Value: o.Networks})
+	}
+	output, err := yaml.Marshal(&data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", COMPOSE_OVERRIDE_FILE, err)
+	}
+	for i, tagged := range taggedPorts {
+		output = bytes.Replace(output, []byte(fmt.Sprintf(OVERRIDE_PLACEHOLDER, i)), tagged, 1)
+	}
+	if err := writeFileAtomic(filepath.Join(fullProjectDir, COMPOSE_OVERRIDE_FILE), output, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", COMPOSE_OVERRIDE_FILE, err)
+	}
+	return nil
+}
+
+// jsonValue converts the maps yaml.v2 unmarshals, which json can't marshal, to maps with string keys
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{})
+		for key, val := range value {
+			converted[fmt.Sprint(key)] = jsonValue(val)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, val := range value {
+			converted[i] = jsonValue(val)
+		}
+		return converted
+	}
+	return value
+}
+
+// readDeployedServices returns the services of the override the project was last deployed with, falling back to the
+// compose files for projects deployed before the agent wrote overrides, when it rewrote docker-compose.yml instead
+func readDeployedServices(fullProjectDir string) (map[interface{}]interface{}, error) {
+	services, err := readComposeServices(filepath.Join(fullProjectDir, COMPOSE_OVERRIDE_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return getComposeServices(fullProjectDir)
+	}
+	return services, err
+}
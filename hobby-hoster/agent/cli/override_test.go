@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compose merges the ports of the override with the project's unless they are tagged !override, which the override
+// puts in place of a placeholder since yaml.v2 can't emit tags
+func TestOverrideTagsOnlyServicePorts(t *testing.T) {
+	dir := t.TempDir()
+	override := newComposeOverride()
+	override.service("web")["ports"] = []interface{}{"1025:80", map[interface{}]interface{}{"target": 443, "published": "1026"}}
+	override.service("web")["labels"] = []interface{}{"traefik.enable=true"}
+	// a service named ports and a deeper ports key mustn't be tagged
+	override.service("ports")["deploy"] = map[interface{}]interface{}{"ports": []interface{}{"8080"}}
+	override.Networks["traefik-public"] = map[interface{}]interface{}{"external": true}
+	if err := override.write(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, COMPOSE_OVERRIDE_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	tagged := 0
+	for i, line := range lines {
+		if !strings.Contains(line, "!override") {
+			continue
+		}
+		tagged++
+		if line != `    ports: !override ["1025:80",{"published":"1026","target":443}]` {
+			t.Errorf("unexpected !override on line %d:\n%s", i+1, data)
+		}
+	}
+	if tagged != 1 {
+		t.Fatalf("expected the ports of web to be tagged once, got %d:\n%s", tagged, data)
+	}
+
+	// the agent reads the override back, e.g. for the ports a project was deployed with
+	services, err := readComposeServices(filepath.Join(dir, COMPOSE_OVERRIDE_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports, _ := services["web"].(map[interface{}]interface{})["ports"].([]interface{})
+	if len(ports) != 2 || ports[0] != "1025:80" {
+		t.Fatalf("expected the ports to read back as [1025:80 map[published:1026 target:443]], got %v", ports)
+	}
+	if long, _ := ports[1].(map[interface{}]interface{}); long["target"] != 443 || long["published"] != "1026" {
+		t.Errorf("expected the long syntax port to read back as it was written, got %v", ports[1])
+	}
+}
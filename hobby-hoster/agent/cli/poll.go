@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var POLL_STATUS_FILE = "/mnt/data/poll-status.json"
+
+// the commits whose deploy failed per subdomain, so a restarted agent doesn't deploy them again either
+var FAILED_DEPLOYS_FILE = "/mnt/data/failed-deploys.json"
+
+// how many poll results are kept per project
+const POLL_HISTORY_SIZE = 20
+
+// failing polls back off exponentially up to this
+const MAX_POLL_BACKOFF = time.Hour
+
+const (
+	PollUpToDate         = "up_to_date"
+	PollDeployScheduled  = "deploy_scheduled"
+	PollDeployInProgress = "deploy_in_progress"
+	PollDeployFailed     = "deploy_failed"
+	PollError            = "error"
+)
+
+type PollResult struct {
+	Subdomain           string    `json:"subdomain"`
+	CheckedAt           time.Time `json:"checked_at"`
+	Outcome             string    `json:"outcome"`
+	Reason              string    `json:"reason"`
+	RemoteCommit        string    `json:"remote_commit,omitempty"`
+	DeployedCommit      string    `json:"deployed_commit,omitempty"`
+	Error               string    `json:"error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	NextPollAt          time.Time `json:"next_poll_at"`
+}
+
+var POLL_STATUS_MUT = &sync.Mutex{}
+
+// loadPollStatus returns the recorded poll results per subdomain, oldest first
+func loadPollStatus() (map[string][]PollResult, error) {
+	status := make(map[string][]PollResult)
+	data, err := os.ReadFile(POLL_STATUS_FILE)
+	if os.IsNotExist(err) {
+		return status, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", POLL_STATUS_FILE, err)
+	}
+	return status, nil
+}
+
+func recordPollResult(result PollResult) error {
+	POLL_STATUS_MUT.Lock()
+	defer POLL_STATUS_MUT.Unlock()
+
+	status, err := loadPollStatus()
+	if err != nil {
+		return err
+	}
+	history := append(status[result.Subdomain], result)
+	if len(history) > POLL_HISTORY_SIZE {
+		history = history[len(history)-POLL_HISTORY_SIZE:]
+	}
+	status[result.Subdomain] = history
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(POLL_STATUS_FILE, data, 0644)
+}
+
+var FAILED_DEPLOYS_MUT = &sync.Mutex{}
+
+func loadFailedDeploys() (map[string]string, error) {
+	failed := make(map[string]string)
+	data, err := os.ReadFile(FAILED_DEPLOYS_FILE)
+	if os.IsNotExist(err) {
+		return failed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &failed); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", FAILED_DEPLOYS_FILE, err)
+	}
+	return failed, nil
+}
+
+// recordFailedDeploy remembers the commit whose deploy of the project failed, or forgets it when commit is empty
+func recordFailedDeploy(subdomain string, commit string) error {
+	FAILED_DEPLOYS_MUT.Lock()
+	defer FAILED_DEPLOYS_MUT.Unlock()
+
+	failed, err := loadFailedDeploys()
+	if err != nil {
+		return err
+	}
+	if commit == "" {
+		if _, ok := failed[subdomain]; !ok {
+			return nil
+		}
+		delete(failed, subdomain)
+	} else {
+		failed[subdomain] = commit
+	}
+
+	data, err := json.MarshalIndent(failed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(FAILED_DEPLOYS_FILE, data, 0644)
+}
+
+// pollBackoff doubles the interval for every consecutive failure
+func pollBackoff(interval time.Duration, failures int) time.Duration {
+	backoff := interval
+	for i := 0; i < failures && backoff < MAX_POLL_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > MAX_POLL_BACKOFF {
+		backoff = MAX_POLL_BACKOFF
+	}
+	return backoff
+}
+
+type projectPoller struct {
+	debouncer *deployDebouncer
+	nextPoll  map[string]time.Time
+	failures  map[string]int
+}
+
+func newProjectPoller(debouncer *deployDebouncer) *projectPoller {
+	return &projectPoller{debouncer: debouncer, nextPoll: make(map[string]time.Time), failures: make(map[string]int)}
+}
+
+// pollProject compares the remote branch with the deployed commit and schedules a deploy when they differ
+func (p *projectPoller) pollProject(domain string, project DesiredProject, interval time.Duration) PollResult {
+	result := PollResult{Subdomain: project.Subdomain, CheckedAt: time.Now()}
+
+	remoteCommit, err := getRemoteCommit(project.Repo, project.Branch)
+	if err != nil {
+		p.failures[project.Subdomain]++
+		result.Outcome = PollError
+		result.Reason = "failed to read the remote branch"
+		result.Error = err.Error()
+		result.ConsecutiveFailures = p.failures[project.Subdomain]
+		result.NextPollAt = time.Now().Add(pollBackoff(interval, p.failures[project.Subdomain]))
+		return result
+	}
+	p.failures[project.Subdomain] = 0
+	result.RemoteCommit = remoteCommit
+	result.NextPollAt = time.Now().Add(interval)
+
+	// a missing checkout simply counts as a different commit
+	deployedCommit, _ := getProjectCommit(project.Subdomain)
+	result.DeployedCommit = deployedCommit
+
+	switch {
+	case p.debouncer.isPending(project.Subdomain):
+		result.Outcome = PollDeployInProgress
+		result.Reason = "a deploy of this project is already scheduled or running"
+	case deployedCommit == remoteCommit:
+		result.Outcome = PollUpToDate
+		result.Reason = "remote commit is already deployed"
+	case p.debouncer.failedCommit(project.Subdomain) == remoteCommit:
+		// the project was rolled back, deploying the same commit again would only fail again
+		result.Outcome = PollDeployFailed
+		result.Reason = fmt.Sprintf("deploying %s failed, waiting for the remote to move", shortCommit(remoteCommit))
+	default:
+		p.debouncer.schedule(deployRequest{Domain: domain, Project: project, Commit: remoteCommit})
+		result.Outcome = PollDeployScheduled
+		if deployedCommit == "" {
+			result.Reason = "project is not deployed"
+		} else {
+			result.Reason = fmt.Sprintf("remote moved from %s to %s", shortCommit(deployedCommit), shortCommit(remoteCommit))
+		}
+	}
+	return result
+}
+
+// run polls every project of the recorded desired state that has a poll_interval whenever it is due.
+// The desired state is re-read on every tick so apply can add, remove or reconfigure projects at any time.
+func (p *projectPoller) run(tick time.Duration) {
+	for {
+		state, err := loadDesiredState()
+		if err != nil {
+			log.Printf("Poller: %v", err)
+		}
+		if state != nil {
+			for _, project := range state.Projects {
+				interval, _ := project.pollInterval()
+				if interval <= 0 || time.Now().Before(p.nextPoll[project.Subdomain]) {
+					continue
+				}
+				result := p.pollProject(state.Domain, project, interval)
+				p.nextPoll[project.Subdomain] = result.NextPollAt
+				if result.Outcome != PollUpToDate {
+					log.Printf("Poller: %s %s: %s %s", project.Subdomain, result.Outcome, result.Reason, result.Error)
+				}
+				if err := recordPollResult(result); err != nil {
+					log.Printf("Poller: failed to record poll result of %s: %v", project.Subdomain, err)
+				}
+			}
+		}
+		time.Sleep(tick)
+	}
+}
+
+var pollsCmd = &cobra.Command{
+	Use:   "polls [subdomain]...",
+	Short: "Show git polling results",
+	Long:  `This command shows when each polled project was last checked, what the remote and deployed commits were and whether a deploy was triggered. With --history, every recorded poll is shown instead of only the last one.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		history, _ := cmd.Flags().GetBool("history")
+
+		status, err := loadPollStatus()
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		subdomains := args
+		if len(subdomains) == 0 {
+			for subdomain := range status {
+				subdomains = append(subdomains, subdomain)
+			}
+			sort.Strings(subdomains)
+		}
+		results := []PollResult{}
+		for _, subdomain := range subdomains {
+			polls := status[subdomain]
+			if len(polls) == 0 {
+				continue
+			}
+			if history {
+				results = append(results, polls...)
+			} else {
+				results = append(results, polls[len(polls)-1])
+			}
+		}
+
+		if jsonOutput {
+			resultsJson, _ := json.Marshal(results)
+			fmt.Println(string(resultsJson))
+			return nil
+		}
+		for _, result := range results {
+			fmt.Printf("%-20s %s  %-18s %s", result.Subdomain, result.CheckedAt.Format(time.RFC3339), result.Outcome, result.Reason)
+			if result.Error != "" {
+				fmt.Printf(": %s", result.Error)
+			}
+			fmt.Println()
+		}
+		return nil
+	},
+}
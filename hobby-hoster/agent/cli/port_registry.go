@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var PORT_REGISTRY_FILE = "/mnt/data/port-registry.json"
+
+// lockPortRegistry keeps every other agent process and goroutine from changing the registry until the returned lock
+// is released, which is held from loading the registry to saving it
+func lockPortRegistry() (*fileLock, error) {
+	return lockFile(PORT_REGISTRY_FILE+".lock", true)
+}
+
+// the host ports handed out to projects, the ones below are privileged
+const FIRST_HOST_PORT = 1025
+const LAST_HOST_PORT = 65535
+
+// PortAllocation is a range of host ports published for a port (or range of ports) of a project's service. It stays
+// the same across rebuilds until the project stops publishing the port or is removed.
+type PortAllocation struct {
+	Subdomain string `json:"subdomain"`
+	Service   string `json:"service"`
+	// ContainerPort is the port or range of ports of the service along with the protocol, e.g. 80/tcp or 7000-7001/udp
+	ContainerPort string `json:"container_port"`
+	// HostPort is the first host port, there is one per container port
+	HostPort    int       `json:"host_port"`
+	Count       int       `json:"count"`
+	AllocatedAt time.Time `json:"allocated_at"`
+}
+
+func (a PortAllocation) key() string {
+	return a.Service + "/" + a.ContainerPort
+}
+
+func (a PortAllocation) lastHostPort() int {
+	return a.HostPort + a.Count - 1
+}
+
+// HostPorts formats the host ports like the ports of a compose file, e.g. 1025 or 1025-1026
+func (a PortAllocation) HostPorts() string {
+	if a.Count > 1 {
+		return fmt.Sprintf("%d-%d", a.HostPort, a.lastHostPort())
+	}
+	return strconv.Itoa(a.HostPort)
+}
+
+func (a PortAllocation) overlaps(first int, count int) bool {
+	return first <= a.lastHostPort() && a.HostPort <= first+count-1
+}
+
+// containerPort formats the container ports of the mapping for PortAllocation.ContainerPort
+func (m PortMapping) containerPort() string {
+	protocol := m.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if m.hostPorts() > 1 {
+		return fmt.Sprintf("%d-%d/%s", m.TargetStart, m.TargetEnd, protocol)
+	}
+	return fmt.Sprintf("%d/%s", m.TargetStart, protocol)
+}
+
+type PortRegistry struct {
+	Allocations []PortAllocation `json:"allocations"`
+}
+
+func loadPortRegistry() (*PortRegistry, error) {
+	registry := &PortRegistry{Allocations: []PortAllocation{}}
+	data, err := os.ReadFile(PORT_REGISTRY_FILE)
+	if os.IsNotExist(err) {
+		return registry, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, registry); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", PORT_REGISTRY_FILE, err)
+	}
+	return registry, nil
+}
+
+func (r *PortRegistry) save() error {
+	sort.Slice(r.Allocations, func(i, k int) bool {
+		if r.Allocations[i].Subdomain != r.Allocations[k].Subdomain {
+			return r.Allocations[i].Subdomain < r.Allocations[k].Subdomain
+		}
+		return r.Allocations[i].HostPort < r.Allocations[k].HostPort
+	})
+	data, _ := json.MarshalIndent(r, "", "  ")
+	return writeFileAtomic(PORT_REGISTRY_FILE, data, 0644)
+}
+
+// isTaken checks the ports against the allocations of every project, and whether anything else already listens on them
+func isTaken(taken []PortAllocation, first int, count int, protocol string, checkHost bool) bool {
+	if first+count-1 > LAST_HOST_PORT {
+		return true
+	}
+	for _, allocation := range taken {
+		if allocation.overlaps(first, count) {
+			return true
+		}
+	}
+	if !checkHost {
+		return false
+	}
+	for port := first; port < first+count; port++ {
+		if !isHostPortFree(port, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHostPortFree(port int, protocol string) bool {
+	address := fmt.Sprintf(":%d", port)
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// deployedHostPorts returns the first host port of every mapping in the override the project runs with, by
+// PortAllocation.key, so a project deployed before the registry existed keeps its ports
+func deployedHostPorts(fullProjectDir string) map[string][]int {
+	deployed := make(map[string][]int)
+	services, err := readComposeServices(filepath.Join(fullProjectDir, COMPOSE_OVERRIDE_FILE))
+	if err != nil {
+		return deployed
+	}
+	for name, service := range services {
+		serviceMap, _ := service.(map[interface{}]interface{})
+		ports, _ := serviceMap["ports"].([]interface{})
+		for _, port := range ports {
+			mapping, err := parsePortMapping(port)
+			if err != nil || mapping.PublishedStart == 0 {
+				continue
+			}
+			key := PortAllocation{Service: fmt.Sprint(name), ContainerPort: mapping.containerPort()}.key()
+			deployed[key] = append(deployed[key], mapping.PublishedStart)
+		}
+	}
+	return deployed
+}
+
+type servicePort struct {
+	service string
+	index   int
+	mapping PortMapping
+}
+
+// portsForServices orders the port mappings of the compose model for allocateHostPorts, by service and then as listed.
+// Variables in the mappings are interpolated from env, e.g. "${PORT}:80".
+func portsForServices(services map[interface{}]interface{}, env map[string]string) ([]servicePort, error) {
+	var ports []servicePort
+	for name, service := range services {
+		serviceMap := service.(map[interface{}]interface{})
+		servicePorts, _ := serviceMap["ports"].([]interface{})
+		for i, port := range servicePorts {
+			port, err := interpolatePort(port, env)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid port mapping of service %v in the compose file: %v", name, err)
+			}
+			mapping, err := parsePortMapping(port)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid port mapping of service %v in the compose file: %v", name, err)
+			}
+			ports = append(ports, servicePort{service: fmt.Sprint(name), index: i, mapping: mapping})
+		}
+	}
+	sort.SliceStable(ports, func(i, k int) bool {
+		if ports[i].service != ports[k].service {
+			return ports[i].service < ports[k].service
+		}
+		return ports[i].index < ports[k].index
+	})
+	return ports, nil
+}
+
+// allocateHostPorts returns the first host port of each of the project's port mappings, in the order given. Mappings
+// that were allocated before keep their host ports, new ones get the lowest free range and the allocations of mappings
+// the project no longer has are released.
+func allocateHostPorts(subdomain string, fullProjectDir string, ports []servicePort) ([]int, error) {
+	lock, err := lockPortRegistry()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	registry, err := loadPortRegistry()
+	if err != nil {
+		return nil, err
+	}
+	var taken []PortAllocation
+	previous := make(map[string][]PortAllocation)
+	for _, allocation := range registry.Allocations {
+		if allocation.Subdomain == subdomain {
+			previous[allocation.key()] = append(previous[allocation.key()], allocation)
+		} else {
+			taken = append(taken, allocation)
+		}
+	}
+
+	// mappings that were allocated before are claimed first, so a new mapping can't take their ports
+	allocations := make([]*PortAllocation, len(ports))
+	for i, port := range ports {
+		allocation := PortAllocation{Subdomain: subdomain, Service: port.service, ContainerPort: port.mapping.containerPort(), Count: port.mapping.hostPorts()}
+		if candidates := previous[allocation.key()]; len(candidates) > 0 && candidates[0].Count == allocation.Count {
+			previous[allocation.key()] = candidates[1:]
+			allocations[i] = &candidates[0]
+			taken = append(taken, candidates[0])
+		}
+	}
+
+	deployed := deployedHostPorts(fullProjectDir)
+	for i, port := range ports {
+		if allocations[i] != nil {
+			continue
+		}
+		allocation := PortAllocation{Subdomain: subdomain, Service: port.service, ContainerPort: port.mapping.containerPort(), Count: port.mapping.hostPorts(), AllocatedAt: time.Now()}
+		protocol := port.mapping.Protocol
+
+		// the ports the project is deployed with are bound by its own containers, so they aren't checked on the host
+		if candidates := deployed[allocation.key()]; len(candidates) > 0 {
+			deployed[allocation.key()] = candidates[1:]
+			if candidates[0] >= FIRST_HOST_PORT && !isTaken(taken, candidates[0], allocation.Count, protocol, false) {
+				allocation.HostPort = candidates[0]
+			}
+		}
+		for first := FIRST_HOST_PORT; allocation.HostPort == 0; first++ {
+			if first+allocation.Count-1 > LAST_HOST_PORT {
+				return nil, fmt.Errorf("no %d free host ports left for %s of service %s", allocation.Count, allocation.ContainerPort, port.service)
+			}
+			if !isTaken(taken, first, allocation.Count, protocol, true) {
+				allocation.HostPort = first
+			}
+		}
+		allocations[i] = &allocation
+		taken = append(taken, allocation)
+	}
+
+	hostPorts := make([]int, len(ports))
+	kept := []PortAllocation{}
+	for _, allocation := range registry.Allocations {
+		if allocation.Subdomain != subdomain {
+			kept = append(kept, allocation)
+		}
+	}
+	for i, allocation := range allocations {
+		hostPorts[i] = allocation.HostPort
+		kept = append(kept, *allocation)
+	}
+	registry.Allocations = kept
+	if err := registry.save(); err != nil {
+		return nil, fmt.Errorf("failed to save the port registry: %v", err)
+	}
+	return hostPorts, nil
+}
+
+// releasePorts frees the host ports of a removed project
+func releasePorts(subdomain string) error {
+	lock, err := lockPortRegistry()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	registry, err := loadPortRegistry()
+	if err != nil {
+		return err
+	}
+	kept := []PortAllocation{}
+	for _, allocation := range registry.Allocations {
+		if allocation.Subdomain != subdomain {
+			kept = append(kept, allocation)
+		}
+	}
+	if len(kept) == len(registry.Allocations) {
+		return nil
+	}
+	registry.Allocations = kept
+	return registry.save()
+}
+
+// getPortAllocations returns the allocations of the given projects, or of all of them when none are given
+func getPortAllocations(subdomains []string) ([]PortAllocation, error) {
+	// the registry is saved atomically, reading it needs no lock
+	registry, err := loadPortRegistry()
+	if err != nil {
+		return nil, err
+	}
+	if len(subdomains) == 0 {
+		return registry.Allocations, nil
+	}
+	wanted := make(map[string]bool)
+	for _, subdomain := range subdomains {
+		wanted[subdomain] = true
+	}
+	allocations := []PortAllocation{}
+	for _, allocation := range registry.Allocations {
+		if wanted[allocation.Subdomain] {
+			allocations = append(allocations, allocation)
+		}
+	}
+	return allocations, nil
+}
+
+var portsCmd = &cobra.Command{
+	Use:   "ports [subdomain...]",
+	Short: "Show the host ports allocated to projects",
+	Long:  `This command shows the host ports published for the services of the given projects (all of them by default). A port keeps its host port across rebuilds until the project stops publishing it or is removed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		allocations, err := getPortAllocations(args)
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		if jsonOutput {
+			allocationsJson, _ := json.Marshal(allocations)
+			fmt.Println(string(allocationsJson))
+			return nil
+		}
+		if len(allocations) == 0 {
+			fmt.Println("No host ports are allocated")
+			return nil
+		}
+		fmt.Printf("%-20s %-15s %-15s %s\n", "SUBDOMAIN", "SERVICE", "CONTAINER", "HOST")
+		for _, allocation := range allocations {
+			fmt.Printf("%-20s %-15s %-15s %s\n", allocation.Subdomain, allocation.Service, allocation.ContainerPort, allocation.HostPorts())
+		}
+		return nil
+	},
+}
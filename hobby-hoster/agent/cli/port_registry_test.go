@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// every allocation loads, changes and saves the whole registry, concurrent ones must not lose each other's ports
+func TestConcurrentAllocationsDontOverlap(t *testing.T) {
+	useComposeRunner(t, newFakeComposeRunner())
+	ports := []servicePort{{service: "web", mapping: PortMapping{TargetStart: 80, TargetEnd: 80}}}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(subdomain string) {
+			defer wg.Done()
+			_, err := allocateHostPorts(subdomain, getProjectPath(subdomain), ports)
+			errs <- err
+		}(fmt.Sprintf("app%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	allocations, err := getPortAllocations(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 10 {
+		t.Fatalf("expected 10 allocations, got %d: %v", len(allocations), allocations)
+	}
+	used := make(map[int]string)
+	for _, allocation := range allocations {
+		if other, ok := used[allocation.HostPort]; ok {
+			t.Errorf("%s and %s were both given host port %d", other, allocation.Subdomain, allocation.HostPort)
+		}
+		used[allocation.HostPort] = allocation.Subdomain
+	}
+}
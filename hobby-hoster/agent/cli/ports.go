@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortMapping is one entry of a service's ports, in the short ("127.0.0.1:8000-8001:80-81/udp") or long syntax
+type PortMapping struct {
+	HostIP string
+	// the container ports, TargetEnd equals TargetStart for a single port
+	TargetStart int
+	TargetEnd   int
+	// the host ports the project asked for, 0 when it leaves them to docker
+	PublishedStart int
+	PublishedEnd   int
+	Protocol       string
+	// Long is the entry in the long syntax, its other fields (mode, name, app_protocol, ...) are kept as they are
+	Long map[interface{}]interface{}
+}
+
+// parsePortRange parses "8080" or "8080-8081"
+func parsePortRange(spec string) (int, int, error) {
+	startSpec, endSpec, isRange := strings.Cut(spec, "-")
+	start, err := strconv.Atoi(startSpec)
+	if err != nil || start < 1 || start > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", spec)
+	}
+	if !isRange {
+		return start, start, nil
+	}
+	end, err := strconv.Atoi(endSpec)
+	if err != nil || end < start || end > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range %q", spec)
+	}
+	return start, end, nil
+}
+
+// interpolatePort expands the variables of a ports entry, in either syntax
+func interpolatePort(port interface{}, env map[string]string) (interface{}, error) {
+	switch p := port.(type) {
+	case string:
+		return interpolate(p, env)
+	case map[interface{}]interface{}:
+		interpolated := make(map[interface{}]interface{}, len(p))
+		for key, val := range p {
+			if valStr, ok := val.(string); ok {
+				expanded, err := interpolate(valStr, env)
+				if err != nil {
+					return nil, err
+				}
+				val = expanded
+			}
+			interpolated[key] = val
+		}
+		return interpolated, nil
+	}
+	return port, nil
+}
+
+// parsePortMapping parses a ports entry of the compose file. The short syntax is split like docker does: the container
+// port(s) after the last colon, the host port(s) before it and the host IP before that, which can be an IPv6 address
+// with or without brackets.
+func parsePortMapping(port interface{}) (PortMapping, error) {
+	var mapping PortMapping
+	var err error
+	switch p := port.(type) {
+	case int:
+		mapping.TargetStart, mapping.TargetEnd = p, p
+	case string:
+		spec := p
+		if rest, protocol, found := strings.Cut(spec, "/"); found {
+			spec, mapping.Protocol = rest, protocol
+		}
+		parts := strings.Split(spec, ":")
+		publishedSpec := ""
+		switch n := len(parts); n {
+		case 1:
+		case 2:
+			publishedSpec = parts[0]
+		default:
+			mapping.HostIP = strings.TrimSuffix(strings.TrimPrefix(strings.Join(parts[:n-2], ":"), "["), "]")
+			publishedSpec = parts[n-2]
+		}
+		if mapping.TargetStart, mapping.TargetEnd, err = parsePortRange(parts[len(parts)-1]); err != nil {
+			return mapping, err
+		}
+		if publishedSpec != "" {
+			if mapping.PublishedStart, mapping.PublishedEnd, err = parsePortRange(publishedSpec); err != nil {
+				return mapping, err
+			}
+		}
+	case map[interface{}]interface{}:
+		mapping.Long = p
+		target, ok := p["target"]
+		if !ok {
+			return mapping, errors.New("port is missing its target")
+		}
+		if mapping.TargetStart, mapping.TargetEnd, err = parsePortRange(fmt.Sprint(target)); err != nil {
+			return mapping, err
+		}
+		if published, ok := p["published"]; ok && published != nil && fmt.Sprint(published) != "" {
+			if mapping.PublishedStart, mapping.PublishedEnd, err = parsePortRange(fmt.Sprint(published)); err != nil {
+				return mapping, err
+			}
+		}
+		if hostIP, ok := p["host_ip"]; ok {
+			mapping.HostIP = fmt.Sprint(hostIP)
+		}
+		if protocol, ok := p["protocol"]; ok {
+			mapping.Protocol = fmt.Sprint(protocol)
+		}
+	default:
+		return mapping, fmt.Errorf("unsupported port type: %T", p)
+	}
+
+	// a range of host ports for a single container port lets docker pick one of them, otherwise they pair up
+	targets := mapping.TargetEnd - mapping.TargetStart + 1
+	if published := mapping.PublishedEnd - mapping.PublishedStart + 1; mapping.PublishedStart != 0 && targets > 1 && published != targets {
+		return mapping, fmt.Errorf("port %v maps %d host ports to %d container ports", port, published, targets)
+	}
+	return mapping, nil
+}
+
+// hostPorts is the number of contiguous host ports the mapping needs
+func (m PortMapping) hostPorts() int {
+	return m.TargetEnd - m.TargetStart + 1
+}
+
+// publishedOn returns the ports entry with the host ports replaced by the ones starting at first, in the syntax it was
+// given in
+func (m PortMapping) publishedOn(first int) interface{} {
+	published := strconv.Itoa(first)
+	if m.hostPorts() > 1 {
+		published = fmt.Sprintf("%d-%d", first, first+m.hostPorts()-1)
+	}
+
+	if m.Long != nil {
+		long := make(map[interface{}]interface{})
+		for key, val := range m.Long {
+			long[key] = val
+		}
+		long["published"] = published
+		return long
+	}
+
+	entry := published + ":" + strconv.Itoa(m.TargetStart)
+	if m.hostPorts() > 1 {
+		entry = fmt.Sprintf("%s:%d-%d", published, m.TargetStart, m.TargetEnd)
+	}
+	if m.HostIP != "" {
+		hostIP := m.HostIP
+		if strings.Contains(hostIP, ":") {
+			hostIP = "[" + hostIP + "]"
+		}
+		entry = hostIP + ":" + entry
+	}
+	if m.Protocol != "" {
+		entry += "/" + m.Protocol
+	}
+	return entry
+}
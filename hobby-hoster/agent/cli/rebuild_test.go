@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testComposeFile = `services:
+  web:
+    build: .
+    labels:
+      - hobby-hoster.enable=true
+`
+
+// writeTestProject creates a checkout of the project at the given commit
+func writeTestProject(t *testing.T, subdomain string, commit string) {
+	dir := getProjectPath(subdomain)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(testComposeFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".hobby-hoster-revision"), []byte(commit), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildProjectBuildFailure(t *testing.T) {
+	runner := newFakeComposeRunner()
+	useComposeRunner(t, runner)
+	writeTestProject(t, "app", "1111111")
+	buildErr := &ComposeError{Op: "build", Project: "app", Err: errors.New("exit status 1")}
+	runner.errs["Build"] = buildErr
+
+	err := rebuildProject("example.com", "app", nil, nil)
+	if !errors.Is(err, buildErr) {
+		t.Fatalf("expected the build error, got %v", err)
+	}
+	if runner.called("Up") != 0 {
+		t.Errorf("containers were started after the build failed: %v", runner.calls)
+	}
+	if _, err := os.Stat(filepath.Join(getProjectPath("app"), COMPOSE_OVERRIDE_FILE)); err != nil {
+		t.Errorf("the override should be written before building: %v", err)
+	}
+}
+
+func TestRebuildProjectOldComposeVersion(t *testing.T) {
+	runner := newFakeComposeRunner()
+	useComposeRunner(t, runner)
+	writeTestProject(t, "app", "1111111")
+	runner.version = "v2.24.3"
+
+	err := rebuildProject("example.com", "app", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "needs 2.24.4 or newer") {
+		t.Fatalf("expected the deploy to fail on the compose version, got %v", err)
+	}
+	if runner.called("Down") != 0 || runner.called("Build") != 0 {
+		t.Errorf("the project was touched with a compose too old for the override: %v", runner.calls)
+	}
+}
+
+// the services that only have an image are pulled before the others are built
+func TestRebuildProjectPullsImagesOfMixedProject(t *testing.T) {
+	runner := newFakeComposeRunner()
+	useComposeRunner(t, runner)
+	runner.containers = []ContainerState{{ID: "c1", Name: "app-web-1", Service: "web", State: "running", Image: "app-web"}}
+	writeTestProject(t, "app", "1111111")
+	compose := testComposeFile + "  db:\n    image: postgres:16\n"
+	if err := os.WriteFile(filepath.Join(getProjectPath("app"), "docker-compose.yml"), []byte(compose), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rebuildProject("example.com", "app", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if calls := strings.Join(runner.calls, ","); !strings.Contains(calls, "Pull,Build,Up") {
+		t.Errorf("expected a pull before the build, got %v", runner.calls)
+	}
+}
+
+func TestWithRollbackAfterFailedHealthCheck(t *testing.T) {
+	runner := newFakeComposeRunner()
+	useComposeRunner(t, runner)
+	runner.containers = []ContainerState{{ID: "c1", Name: "app-web-1", Service: "web", State: "running", Image: "app-web"}}
+
+	writeTestProject(t, "app", "1111111")
+	err := withRollback("app", nil, func() error {
+		return rebuildProject("example.com", "app", nil, nil)
+	})
+	if err != nil {
+		t.Fatalf("first deploy failed: %v", err)
+	}
+
+	// the new release crashes right away
+	runner.state = "exited"
+	runner.exitCode = 1
+	upsBefore := runner.called("Up")
+	err = withRollback("app", nil, func() error {
+		writeTestProject(t, "app", "2222222")
+		return rebuildProject("example.com", "app", nil, nil)
+	})
+
+	var healthErr *HealthCheckError
+	if !errors.As(err, &healthErr) {
+		t.Fatalf("expected a health check error, got %v", err)
+	}
+	rollback := rollbackReportOf(err)
+	if rollback == nil || !rollback.Success || rollback.Commit != "1111111" {
+		t.Fatalf("expected a successful rollback to 1111111, got %+v", rollback)
+	}
+	if !strings.Contains(rollback.Reason, "health check of service web") {
+		t.Errorf("rollback reason doesn't name the failed health check: %s", rollback.Reason)
+	}
+	commit, err := getProjectCommit("app")
+	if err != nil || commit != "1111111" {
+		t.Errorf("checkout wasn't restored, commit is %q (%v)", commit, err)
+	}
+	// once for the deploy and once to bring the previous release back
+	if ups := runner.called("Up") - upsBefore; ups != 2 {
+		t.Errorf("expected 2 ups, got %d: %v", ups, runner.calls)
+	}
+}
+
+func TestComposeRunnerFallsBackToCLI(t *testing.T) {
+	useComposeRunner(t, nil)
+	backend, socket := DOCKER_BACKEND, DOCKER_SOCKET
+	t.Cleanup(func() {
+		DOCKER_BACKEND, DOCKER_SOCKET = backend, socket
+	})
+	DOCKER_BACKEND = "auto"
+	DOCKER_SOCKET = filepath.Join(t.TempDir(), "docker.sock")
+
+	if _, ok := getComposeRunner().(*composeCLIRunner); !ok {
+		t.Fatalf("expected the docker compose CLI runner without a socket, got %T", getComposeRunner())
+	}
+}
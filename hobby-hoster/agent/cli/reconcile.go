@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var DESIRED_STATE_FILE = "/mnt/data/desired-state.json"
+var DRIFT_REPORT_FILE = "/mnt/data/drift-report.json"
+
+type DriftPolicy string
+
+const (
+	DriftPolicyReport DriftPolicy = "report"
+	DriftPolicyRepair DriftPolicy = "repair"
+)
+
+const (
+	DriftMissingDirectory  = "missing_directory"
+	DriftCommitMismatch    = "commit_mismatch"
+	DriftContainersDown    = "containers_not_running"
+	DriftTraefikLabels     = "traefik_labels_missing"
+	DriftUnexpectedService = "unexpected_service"
+	DriftInspectionFailure = "inspection_failed"
+)
+
+type DriftIssue struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+type DriftReport struct {
+	Subdomain   string       `json:"subdomain"`
+	Policy      DriftPolicy  `json:"policy"`
+	Drifted     bool         `json:"drifted"`
+	Issues      []DriftIssue `json:"issues"`
+	Repaired    bool         `json:"repaired,omitempty"`
+	RepairError string       `json:"repair_error,omitempty"`
+	// Rollback is set when the repair failed and the previous release was restored
+	Rollback *RollbackReport `json:"rollback,omitempty"`
+	// Skipped is set when another operation was working on the project, it is checked again next time
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+type DriftSummary struct {
+	CheckedAt time.Time     `json:"checked_at"`
+	Drifted   bool          `json:"drifted"`
+	Projects  []DriftReport `json:"projects"`
+}
+
+// lockDesiredState keeps other agent processes from saving the desired state until the returned lock is released
+func lockDesiredState() (*fileLock, error) {
+	return lockFile(DESIRED_STATE_FILE+".lock", true)
+}
+
+func saveDesiredState(state DesiredState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(DESIRED_STATE_FILE, data, 0644)
+}
+
+// recordDeployedCommit updates the commit of a project in the recorded desired state after it was deployed
+// outside of apply (e.g. by a webhook), so drift detection compares against what was deployed last.
+func recordDeployedCommit(subdomain string, commit string) error {
+	lock, err := lockDesiredState()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	state, err := loadDesiredState()
+	if err != nil || state == nil {
+		return err
+	}
+	for i := range state.Projects {
+		if state.Projects[i].Subdomain == subdomain {
+			state.Projects[i].Commit = commit
+		}
+	}
+	return saveDesiredState(*state)
+}
+
+// loadDesiredState returns the state recorded by the last apply, or nil if apply never ran on this agent
+func loadDesiredState() (*DesiredState, error) {
+	data, err := os.ReadFile(DESIRED_STATE_FILE)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state DesiredState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", DESIRED_STATE_FILE, err)
+	}
+	return &state, nil
+}
+
+// writeFileAtomic replaces the file so readers never see it half written. Every write goes through a temporary file of
+// its own, the agent's goroutines and processes write the same files, and it has the final mode before it is in place.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// CreateTemp creates the file 0600, so secrets are never readable by others
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// expectedComposeServices returns the services `docker compose up` starts, i.e. the ones not hidden behind a profile
+func expectedComposeServices(fullProjectDir string) ([]string, error) {
+	services, err := getComposeServices(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name, service := range services {
+		if serviceMap, ok := service.(map[interface{}]interface{}); ok {
+			if _, hasProfiles := serviceMap["profiles"]; hasProfiles {
+				continue
+			}
+		}
+		names = append(names, fmt.Sprint(name))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// hasTraefikRouterLabels checks that the labels rebuildService injects are still in the compose override
+func hasTraefikRouterLabels(fullProjectDir string, subdomain string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(fullProjectDir, COMPOSE_OVERRIDE_FILE))
+	if os.IsNotExist(err) {
+		// never deployed since the checkout, or by an agent that rewrote the compose file instead
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	content := string(data)
+	// a project whose routed services all have a prefix has no router named after the bare subdomain
+	router := regexp.MustCompile(fmt.Sprintf(`traefik\.http\.routers\.%s(_[a-z0-9-]+)?\.rule=`, regexp.QuoteMeta(subdomain)))
+	return strings.Contains(content, "traefik.enable=true") && router.MatchString(content), nil
+}
+
+// detectProjectDrift compares one recorded project with what is on disk and running
+func detectProjectDrift(project DesiredProject) []DriftIssue {
+	issues := []DriftIssue{}
+	fullProjectDir := getProjectPath(project.Subdomain)
+
+	if _, err := os.Stat(fullProjectDir); os.IsNotExist(err) {
+		return append(issues, DriftIssue{Kind: DriftMissingDirectory, Detail: fmt.Sprintf("%s does not exist", fullProjectDir)})
+	}
+
+	if project.Commit != "" {
+		head, err := getProjectCommit(project.Subdomain)
+		if err != nil {
+			issues = append(issues, DriftIssue{Kind: DriftInspectionFailure, Detail: fmt.Sprintf("failed to read HEAD: %v", err)})
+		} else if head != project.Commit {
+			issues = append(issues, DriftIssue{Kind: DriftCommitMismatch, Detail: fmt.Sprintf("HEAD is %s, expected %s", head, project.Commit)})
+		}
+	}
+
+	hasLabels, err := hasTraefikRouterLabels(fullProjectDir, project.Subdomain)
+	if err != nil {
+		issues = append(issues, DriftIssue{Kind: DriftInspectionFailure, Detail: fmt.Sprintf("failed to read %s: %v", COMPOSE_OVERRIDE_FILE, err)})
+	} else if !hasLabels {
+		issues = append(issues, DriftIssue{Kind: DriftTraefikLabels, Detail: COMPOSE_OVERRIDE_FILE + " no longer contains the injected Traefik router labels"})
+	}
+
+	expected, err := expectedComposeServices(fullProjectDir)
+	if err != nil {
+		return append(issues, DriftIssue{Kind: DriftInspectionFailure, Detail: fmt.Sprintf("failed to parse the compose files: %v", err)})
+	}
+	containers, err := getComposeRunner().Ps(newComposeProject(project.Subdomain, nil))
+	if err != nil {
+		return append(issues, DriftIssue{Kind: DriftInspectionFailure, Detail: err.Error()})
+	}
+	healthy := make(map[string]bool)
+	states := make(map[string]string)
+	for _, container := range containers {
+		states[container.Service] = container.State
+		// one-shot services (e.g. migrations) that exited cleanly are fine
+		if container.State == "running" || (container.State == "exited" && container.ExitCode == 0) {
+			healthy[container.Service] = true
+		}
+	}
+	var down []string
+	for _, service := range expected {
+		if healthy[service] {
+			continue
+		}
+		state := states[service]
+		if state == "" {
+			state = "missing"
+		}
+		down = append(down, fmt.Sprintf("%s (%s)", service, state))
+	}
+	if len(down) > 0 {
+		issues = append(issues, DriftIssue{Kind: DriftContainersDown, Detail: strings.Join(down, ", ")})
+	}
+
+	return issues
+}
+
+// repairProject brings a drifted project back to the desired state. A missing checkout or a moved HEAD
+// needs a fresh clone of the recorded commit, anything else is fixed by rebuilding, which rewrites the labels and starts the containers.
+func repairProject(domain string, project DesiredProject, issues []DriftIssue, out *OpOutput) error {
+	needsClone := false
+	for _, issue := range issues {
+		if issue.Kind == DriftMissingDirectory || issue.Kind == DriftCommitMismatch {
+			needsClone = true
+		}
+	}
+	if !needsClone {
+		return rebuildService(domain, project.Subdomain, project.ExtraTraefikLabels, out)
+	}
+	// repairing restores the recorded commit, moving a project to a newer one is up to apply, webhooks and polling
+	return deployProjectAt(domain, project, project.Commit, out)
+}
+
+// reconcile checks every project of the recorded desired state for drift and, when repair is set,
+// repairs the projects whose policy allows it. Services that are not part of the desired state are only reported.
+func reconcile(repair bool, out *OpOutput) (DriftSummary, error) {
+	summary := DriftSummary{CheckedAt: time.Now(), Projects: []DriftReport{}}
+
+	state, err := loadDesiredState()
+	if err != nil {
+		return summary, err
+	}
+	if state == nil {
+		return summary, errors.New("no desired state recorded, run apply first")
+	}
+
+	desired := make(map[string]bool)
+	for _, project := range state.Projects {
+		desired[project.Subdomain] = true
+		policy := project.DriftPolicy
+		if policy == "" {
+			policy = DriftPolicyReport
+		}
+
+		// a project in the middle of a deploy looks drifted, it is left to the operation working on it
+		lock, err := tryLockProject(project.Subdomain)
+		if errors.Is(err, errLocked) {
+			summary.Projects = append(summary.Projects, DriftReport{Subdomain: project.Subdomain, Policy: policy, Issues: []DriftIssue{}, Skipped: true})
+			continue
+		} else if err != nil {
+			return summary, err
+		}
+		issues := detectProjectDrift(project)
+		report := DriftReport{Subdomain: project.Subdomain, Policy: policy, Issues: issues, Drifted: len(issues) > 0}
+		if report.Drifted && repair && policy == DriftPolicyRepair {
+			if err := repairProject(state.Domain, project, issues, out); err != nil {
+				report.RepairError = err.Error()
+				report.Rollback = rollbackReportOf(err)
+			} else {
+				report.Repaired = true
+			}
+		}
+		lock.Unlock()
+		summary.Drifted = summary.Drifted || report.Drifted
+		summary.Projects = append(summary.Projects, report)
+	}
+
+	services, err := listServices()
+	if err != nil {
+		return summary, err
+	}
+	for _, service := range services {
+		if desired[service.Subdomain] {
+			continue
+		}
+		summary.Drifted = true
+		summary.Projects = append(summary.Projects, DriftReport{
+			Subdomain: service.Subdomain,
+			Policy:    DriftPolicyReport,
+			Drifted:   true,
+			Issues:    []DriftIssue{{Kind: DriftUnexpectedService, Detail: "deployed but not part of the desired state"}},
+		})
+	}
+
+	return summary, nil
+}
+
+// runReconciler checks for drift every interval, repairing projects whose policy is "repair",
+// and records the latest report so `drift --last` and GET /v1/drift?last=true can return it.
+func runReconciler(interval time.Duration) {
+	busy := newBusyRounds("Reconciler")
+	for {
+		time.Sleep(interval)
+		summary, err := reconcile(true, nil)
+		if err != nil {
+			log.Printf("Reconciler: %v", err)
+			continue
+		}
+		var skipped []string
+		for _, report := range summary.Projects {
+			if report.Skipped {
+				skipped = append(skipped, report.Subdomain)
+			}
+		}
+		busy.update(skipped)
+		for _, report := range summary.Projects {
+			if !report.Drifted {
+				continue
+			}
+			var kinds []string
+			for _, issue := range report.Issues {
+				kinds = append(kinds, issue.Kind)
+			}
+			log.Printf("Reconciler: %s drifted (%s), policy %s, repaired: %v %s", report.Subdomain, strings.Join(kinds, ", "), report.Policy, report.Repaired, report.RepairError)
+		}
+		data, _ := json.MarshalIndent(summary, "", "  ")
+		if err := writeFileAtomic(DRIFT_REPORT_FILE, data, 0644); err != nil {
+			log.Printf("Reconciler: failed to save drift report: %v", err)
+		}
+	}
+}
+
+func loadLastDriftSummary() (*DriftSummary, error) {
+	data, err := os.ReadFile(DRIFT_REPORT_FILE)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no drift report recorded yet, is the reconciler running (serve --reconcile-interval)?")
+	} else if err != nil {
+		return nil, err
+	}
+	var summary DriftSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+var driftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Report drift from the desired state",
+	Long: `This command compares the desired state recorded by the last apply with what is actually deployed
+(project directories, HEAD commits, compose containers and the injected Traefik labels) and reports the differences.
+With --repair, drifted projects whose drift_policy is "repair" are repaired. With --last, the report of the last
+background reconciler run is shown instead.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		repair, _ := cmd.Flags().GetBool("repair")
+		last, _ := cmd.Flags().GetBool("last")
+
+		var summary *DriftSummary
+		var err error
+		if last {
+			summary, err = loadLastDriftSummary()
+		} else {
+			var fresh DriftSummary
+			fresh, err = reconcile(repair, newCLIOutput(cmd))
+			summary = &fresh
+		}
+
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		if jsonOutput {
+			summaryJson, _ := json.Marshal(summary)
+			fmt.Println(string(summaryJson))
+			return nil
+		}
+		for _, report := range summary.Projects {
+			status := "ok"
+			if report.Skipped {
+				status = "skipped, another operation is in progress"
+			}
+			if report.Drifted {
+				status = "drifted"
+			}
+			if report.Repaired {
+				status = "repaired"
+			} else if report.RepairError != "" {
+				status = "repair failed: " + report.RepairError
+			}
+			fmt.Printf("%-20s %-8s %s\n", report.Subdomain, report.Policy, status)
+			for _, issue := range report.Issues {
+				fmt.Printf("    %s: %s\n", issue.Kind, issue.Detail)
+			}
+		}
+		return nil
+	},
+}
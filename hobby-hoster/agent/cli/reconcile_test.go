@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomicConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- writeFileAtomic(path, []byte(fmt.Sprintf(`{"writer": %d}`, i)), 0600)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+	files, _ := os.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Errorf("temporary files were left behind: %v", files)
+	}
+}
+
+// gitCommit commits the compose file with the given comment to the repository in dir and returns the commit
+func gitCommit(t *testing.T, dir string, comment string) string {
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte("# "+comment+"\n"+testComposeFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-qm", comment}} {
+		if output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, output)
+		}
+	}
+	commit, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(commit))
+}
+
+func TestRepairRestoresRecordedCommit(t *testing.T) {
+	runner := newFakeComposeRunner()
+	useComposeRunner(t, runner)
+	runner.containers = []ContainerState{{ID: "c1", Name: "app-web-1", Service: "web", State: "running", Image: "app-web"}}
+	repo := t.TempDir()
+	if output, err := exec.Command("git", "init", "-q", "-b", "main", repo).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, output)
+	}
+	recorded := gitCommit(t, repo, "first")
+	head := gitCommit(t, repo, "second")
+
+	project := DesiredProject{Subdomain: "app", Repo: repo, Branch: "main", Commit: recorded}
+	if err := saveDesiredState(DesiredState{Domain: "example.com", Projects: []DesiredProject{project}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cloneService(cloneTarget{Repo: repo, Subdomain: "app", Branch: "main"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	issues := detectProjectDrift(project)
+	if len(issues) == 0 || issues[0].Kind != DriftCommitMismatch {
+		t.Fatalf("expected the moved HEAD to be reported, got %+v", issues)
+	}
+
+	if err := repairProject("example.com", project, issues, nil); err != nil {
+		t.Fatal(err)
+	}
+	if commit, err := getProjectCommit("app"); err != nil || commit != recorded {
+		t.Errorf("expected the recorded commit %s to be checked out, got %q (%v), the branch head is %s", recorded, commit, err, head)
+	}
+	state, err := loadDesiredState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Projects[0].Commit != recorded {
+		t.Errorf("repair changed the desired commit to %s", state.Projects[0].Commit)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// credentials live next to the projects on the data volume, so they survive the instance being replaced
+var REGISTRY_CREDENTIALS_FILE = "/mnt/data/registry-credentials.json"
+
+// lockRegistryCredentials keeps other agent processes (e.g. `registry login` next to `serve`) from changing the
+// credentials until the returned lock is released
+func lockRegistryCredentials() (*fileLock, error) {
+	return lockFile(REGISTRY_CREDENTIALS_FILE+".lock", true)
+}
+
+// the registry images without a registry host (e.g. "nginx" or "library/nginx") come from
+const DEFAULT_REGISTRY = "docker.io"
+
+type RegistryCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func loadRegistryCredentials() (map[string]RegistryCredential, error) {
+	credentials := make(map[string]RegistryCredential)
+	data, err := os.ReadFile(REGISTRY_CREDENTIALS_FILE)
+	if os.IsNotExist(err) {
+		return credentials, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", REGISTRY_CREDENTIALS_FILE, err)
+	}
+	return credentials, nil
+}
+
+// updateRegistryCredentials stores the credential of a registry, or forgets it when credential is nil
+func updateRegistryCredentials(registry string, credential *RegistryCredential) error {
+	lock, err := lockRegistryCredentials()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	credentials, err := loadRegistryCredentials()
+	if err != nil {
+		return err
+	}
+	if credential == nil {
+		delete(credentials, registry)
+	} else {
+		credentials[registry] = *credential
+	}
+	data, err := json.MarshalIndent(credentials, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the file holds passwords, keep it private to the agent's user
+	return writeFileAtomic(REGISTRY_CREDENTIALS_FILE, data, 0600)
+}
+
+// imageRegistry returns the registry host of an image reference, like docker does: the first path component
+// is a registry if it looks like a host name (has a dot or a port, or is localhost)
+func imageRegistry(image string) string {
+	first, _, found := strings.Cut(image, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first
+	}
+	return DEFAULT_REGISTRY
+}
+
+// composeImages returns the image of every service that has one, and whether any service is built from source
+func composeImages(fullProjectDir string) ([]string, bool, error) {
+	services, err := getComposeServices(fullProjectDir)
+	if err != nil {
+		return nil, false, err
+	}
+	env, err := readDotEnv(fullProjectDir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var images []string
+	builds := false
+	for _, service := range services {
+		serviceMap, ok := service.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := serviceMap["build"]; ok {
+			builds = true
+		} else if image, ok := serviceMap["image"].(string); ok {
+			// e.g. ghcr.io/owner/app:${TAG}
+			image, err := interpolate(image, env)
+			if err != nil {
+				return nil, false, fmt.Errorf("image %s: %v", serviceMap["image"], err)
+			}
+			images = append(images, image)
+		}
+	}
+	sort.Strings(images)
+	return images, builds, nil
+}
+
+// loginToRegistries logs docker in to every registry the project pulls from that the agent has credentials for
+func loginToRegistries(project ComposeProject) error {
+	images, _, err := composeImages(project.Dir)
+	if err != nil {
+		return err
+	}
+	credentials, err := loadRegistryCredentials()
+	if err != nil {
+		return err
+	}
+	loggedIn := make(map[string]bool)
+	for _, image := range images {
+		registry := imageRegistry(image)
+		credential, ok := credentials[registry]
+		if !ok || loggedIn[registry] {
+			continue
+		}
+		if err := dockerLogin(project, registry, credential); err != nil {
+			return err
+		}
+		loggedIn[registry] = true
+	}
+	return nil
+}
+
+func dockerLogin(project ComposeProject, registry string, credential RegistryCredential) error {
+	cmd := NewCmdWrap(project.Dir, "docker", "login", registry, "--username", credential.Username, "--password-stdin").RecordTo(project.Output, project.Subdomain, "login")
+	cmd.cmd.Stdin = strings.NewReader(credential.Password)
+	cmd.Run()
+	if cmd.err != nil {
+		return fmt.Errorf("Failed to log in to %s: %v", registry, strings.TrimSpace(cmd.stderr.String()))
+	}
+	return nil
+}
+
+// getComposeRevision identifies a compose file deployed without a repository the way a commit identifies a checkout
+func getComposeRevision(compose string) string {
+	sum := sha256.Sum256([]byte(compose))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeComposeProject deploys a project given as a compose file instead of a repository, the counterpart of cloneService
+func writeComposeProject(subdomain string, compose string, out *OpOutput) error {
+	fullProjectDir := getProjectPath(subdomain)
+	if err := os.RemoveAll(fullProjectDir); err != nil {
+		return fmt.Errorf("Failed to remove existing directory %s: %v", fullProjectDir, err)
+	}
+	if err := os.MkdirAll(fullProjectDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(fullProjectDir, "docker-compose.yml"), []byte(compose), 0644); err != nil {
+		return err
+	}
+	revision := getComposeRevision(compose)
+	newComposeProject(subdomain, out).logf("write", "Wrote docker-compose.yml (revision %s)", shortCommit(revision))
+	// the checkout of a repository has its commit, the revision of a compose file is kept on the side
+	return os.WriteFile(filepath.Join(fullProjectDir, ".hobby-hoster-revision"), []byte(revision), 0644)
+}
+
+var registryCmd = &cobra.Command{
+	Use:   "registry",
+	Short: "Manage container registry credentials",
+	Long:  `This command manages the credentials the agent uses to pull images of image-only projects from private registries.`,
+}
+
+var registryLoginCmd = &cobra.Command{
+	Use:   "login [registry] --username [username]",
+	Short: "Store the credentials of a registry",
+	Long:  `This command reads the password (or access token) from stdin, checks it with docker login and stores it for pulls. Use docker.io for Docker Hub.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		username, _ := cmd.Flags().GetString("username")
+		printError := func(err error) error {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		if username == "" {
+			return printError(errors.New("--username is required"))
+		}
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return printError(fmt.Errorf("no password on stdin: %v", err))
+		}
+		credential := RegistryCredential{Username: username, Password: password}
+		if err := dockerLogin(ComposeProject{Dir: "/"}, args[0], credential); err != nil {
+			return printError(err)
+		}
+		if err := updateRegistryCredentials(args[0], &credential); err != nil {
+			return printError(err)
+		}
+		if jsonOutput {
+			fmt.Println(`{"success": true}`)
+		}
+		return nil
+	},
+}
+
+var registryLogoutCmd = &cobra.Command{
+	Use:   "logout [registry]",
+	Short: "Forget the credentials of a registry",
+	Long:  `This command removes the stored credentials of a registry.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		if err := updateRegistryCredentials(args[0], nil); err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+		if jsonOutput {
+			fmt.Println(`{"success": true}`)
+		}
+		return nil
+	},
+}
+
+var registryListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List registries with stored credentials",
+	Long:  `This command lists the registries the agent has credentials for, along with the username. Passwords are never printed.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		credentials, err := loadRegistryCredentials()
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		registries := []map[string]string{}
+		for registry, credential := range credentials {
+			registries = append(registries, map[string]string{"registry": registry, "username": credential.Username})
+		}
+		sort.Slice(registries, func(i, k int) bool { return registries[i]["registry"] < registries[k]["registry"] })
+		if jsonOutput {
+			registriesJson, _ := json.Marshal(registries)
+			fmt.Println(string(registriesJson))
+			return nil
+		}
+		for _, registry := range registries {
+			fmt.Printf("%-30s %s\n", registry["registry"], registry["username"])
+		}
+		return nil
+	},
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// a login must not drop the credential another one stored at the same time
+func TestConcurrentRegistryLogins(t *testing.T) {
+	useComposeRunner(t, newFakeComposeRunner())
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(registry string) {
+			defer wg.Done()
+			errs <- updateRegistryCredentials(registry, &RegistryCredential{Username: "user", Password: "secret"})
+		}(fmt.Sprintf("registry%d.example.com", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	credentials, err := loadRegistryCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 10 {
+		t.Errorf("expected 10 credentials, got %d", len(credentials))
+	}
+	info, err := os.Stat(REGISTRY_CREDENTIALS_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the credentials to be private, mode is %v", info.Mode().Perm())
+	}
+}
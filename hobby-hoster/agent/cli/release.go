@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the last successfully deployed release of every project is kept here: a copy of the checkout
+// (including the compose override) and release.json, which lists the images it ran
+var RELEASES_DIR = "/mnt/data/releases"
+
+// Release is the last successfully deployed state of a project
+type Release struct {
+	Subdomain string    `json:"subdomain"`
+	Commit    string    `json:"commit"`
+	SavedAt   time.Time `json:"saved_at"`
+	// Images maps the image each service ran (e.g. "blog-web") to the tag that keeps it around
+	Images map[string]string `json:"images"`
+	// Deployed lists the exact image every service ran, which identifies image-only projects the way a commit does
+	Deployed []DeployedImage `json:"deployed"`
+}
+
+type DeployedImage struct {
+	Service string `json:"service"`
+	Image   string `json:"image"`
+	Digest  string `json:"digest"`
+}
+
+// RollbackReport is what the result of a failed deploy says about the rollback
+type RollbackReport struct {
+	Reason  string `json:"reason"`
+	Commit  string `json:"commit,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RollbackError is returned when a deploy failed and the previous release was (or could not be) restored
+type RollbackError struct {
+	Err      error
+	Rollback RollbackReport
+}
+
+func (e *RollbackError) Error() string {
+	if e.Rollback.Success {
+		return fmt.Sprintf("%v (rolled back to %s)", e.Err, shortCommit(e.Rollback.Commit))
+	}
+	return fmt.Sprintf("%v (rollback failed: %s)", e.Err, e.Rollback.Error)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// rollbackReportOf returns the rollback that happened as part of err, if any
+func rollbackReportOf(err error) *RollbackReport {
+	var rollbackErr *RollbackError
+	if errors.As(err, &rollbackErr) {
+		return &rollbackErr.Rollback
+	}
+	return nil
+}
+
+var errNoRelease = errors.New("no previous release to roll back to")
+
+func getReleasePath(subdomain string) string {
+	return filepath.Join(RELEASES_DIR, subdomain)
+}
+
+// getReleaseImageTag is where the image of a service is kept, scoped by subdomain so projects using the same image don't share the tag
+func getReleaseImageTag(subdomain string, service string) string {
+	return strings.ToLower(fmt.Sprintf("hobby-hoster-release/%s-%s:previous", subdomain, service))
+}
+
+func loadRelease(subdomain string) (*Release, error) {
+	data, err := os.ReadFile(filepath.Join(getReleasePath(subdomain), "release.json"))
+	if os.IsNotExist(err) {
+		return nil, errNoRelease
+	} else if err != nil {
+		return nil, err
+	}
+	var release Release
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// saveRelease records what is running now as the release to roll back to. It runs after every successful deploy.
+func saveRelease(runner ComposeRunner, project ComposeProject) error {
+	commit, err := getProjectCommit(project.Subdomain)
+	if err != nil {
+		return err
+	}
+	quiet := project
+	quiet.Output = nil
+	containers, err := runner.Ps(quiet)
+	if err != nil {
+		return err
+	}
+
+	release := Release{Subdomain: project.Subdomain, Commit: commit, SavedAt: time.Now(), Images: make(map[string]string), Deployed: []DeployedImage{}}
+	seen := make(map[string]bool)
+	for _, container := range containers {
+		if container.Image == "" || seen[container.Service] {
+			continue
+		}
+		seen[container.Service] = true
+		digest, err := runner.ImageDigest(quiet, container.Image)
+		if err != nil {
+			return err
+		}
+		release.Deployed = append(release.Deployed, DeployedImage{Service: container.Service, Image: container.Image, Digest: digest})
+
+		if release.Images[container.Image] != "" {
+			continue
+		}
+		tag := getReleaseImageTag(project.Subdomain, container.Service)
+		if err := runner.TagImage(project, container.Image, tag); err != nil {
+			return err
+		}
+		release.Images[container.Image] = tag
+	}
+	sort.Slice(release.Deployed, func(i, k int) bool { return release.Deployed[i].Service < release.Deployed[k].Service })
+
+	releaseDir := getReleasePath(project.Subdomain)
+	tmpCheckout := filepath.Join(releaseDir, "checkout.tmp")
+	os.RemoveAll(tmpCheckout)
+	if err := copyDir(project.Dir, tmpCheckout); err != nil {
+		return fmt.Errorf("failed to copy the checkout: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(releaseDir, "checkout")); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpCheckout, filepath.Join(releaseDir, "checkout")); err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(release, "", "  ")
+	return writeFileAtomic(filepath.Join(releaseDir, "release.json"), data, 0644)
+}
+
+// rollbackRelease replaces the project directory with the saved release, points the image names back
+// at the images it ran and brings the containers up again. Nothing is taken down first: compose only recreates
+// containers that differ from the release, so after a failed zero-downtime deploy the old containers keep running.
+func rollbackRelease(runner ComposeRunner, project ComposeProject) (*Release, error) {
+	release, err := loadRelease(project.Subdomain)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir := project.Dir + ".rollback"
+	os.RemoveAll(tmpDir)
+	if err := copyDir(filepath.Join(getReleasePath(project.Subdomain), "checkout"), tmpDir); err != nil {
+		return release, fmt.Errorf("failed to restore the checkout: %v", err)
+	}
+	if err := os.RemoveAll(project.Dir); err != nil {
+		return release, err
+	}
+	if err := os.Rename(tmpDir, project.Dir); err != nil {
+		return release, err
+	}
+
+	for image, tag := range release.Images {
+		if err := runner.TagImage(project, tag, image); err != nil {
+			return release, err
+		}
+	}
+	return release, runner.Up(project)
+}
+
+// withRollback runs a deploy of the project. When it succeeds, the result becomes the release to roll back to,
+// when it fails, the previous release is restored and a *RollbackError describes both.
+func withRollback(subdomain string, out *OpOutput, deploy func() error) error {
+	runner := getComposeRunner()
+	project := newComposeProject(subdomain, out)
+
+	deployErr := deploy()
+	if deployErr == nil {
+		if err := saveRelease(runner, project); err != nil {
+			// the deploy itself worked, the next failure just can't be rolled back to this one
+			project.logf("release", "Failed to save the release for rollbacks: %v", err)
+		}
+		return nil
+	}
+
+	if _, err := loadRelease(subdomain); err == errNoRelease {
+		return deployErr
+	}
+	project.logf("rollback", "Deploy failed, rolling back to the previous release: %v", deployErr)
+	report := RollbackReport{Reason: deployErr.Error()}
+	release, err := rollbackRelease(runner, project)
+	if release != nil {
+		report.Commit = release.Commit
+	}
+	if err != nil {
+		report.Error = err.Error()
+		project.logf("rollback", "Rollback failed: %v", err)
+	} else {
+		report.Success = true
+		project.logf("rollback", "Rolled back to %s", shortCommit(release.Commit))
+	}
+	return &RollbackError{Err: deployErr, Rollback: report}
+}
+
+// removeRelease forgets the saved release of a removed project, including the image tags keeping its images alive
+func removeRelease(runner ComposeRunner, project ComposeProject) error {
+	release, err := loadRelease(project.Subdomain)
+	if err == errNoRelease {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, tag := range release.Images {
+		if err := runner.RemoveImage(project, tag); err != nil && !isDockerNotFound(err) {
+			project.logf("remove", "Failed to remove release image %s: %v", tag, err)
+		}
+	}
+	return os.RemoveAll(getReleasePath(project.Subdomain))
+}
+
+// copyDir copies a directory tree, keeping file modes and symlinks
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			// sockets, devices and the like have no business in a checkout
+			return nil
+		}
+	})
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
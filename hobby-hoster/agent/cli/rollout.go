@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type DeployStrategy string
+
+const (
+	// DeployRecreate takes the project down, builds and starts it again. The site is offline during the build.
+	DeployRecreate DeployStrategy = "recreate"
+	// DeployZeroDowntime builds first and swaps the routed container for a new one once that one is up
+	DeployZeroDowntime DeployStrategy = "zero-downtime"
+)
+
+// getDeployStrategy reads the hobby-hoster.deploy label, recreate is the default
+func getDeployStrategy(hobbyHosterMetadata map[string]string) (DeployStrategy, error) {
+	switch strategy := DeployStrategy(hobbyHosterMetadata["deploy"]); strategy {
+	case "":
+		return DeployRecreate, nil
+	case DeployRecreate, DeployZeroDowntime:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid hobby-hoster.deploy label %q, expected %q or %q", strategy, DeployRecreate, DeployZeroDowntime)
+	}
+}
+
+// checkScalable makes sure two containers of the service can run side by side during a zero-downtime deploy:
+// a fixed container_name or published host ports would clash between the old and the new one
+func checkScalable(name string, serviceMap map[interface{}]interface{}) error {
+	if _, ok := serviceMap["container_name"]; ok {
+		return fmt.Errorf("zero-downtime deploys are not possible for service %v: it sets container_name", name)
+	}
+	if ports, ok := serviceMap["ports"].([]interface{}); ok && len(ports) > 0 {
+		return fmt.Errorf("zero-downtime deploys are not possible for service %v: it publishes host ports", name)
+	}
+	return nil
+}
+
+// logf emits a line of agent output for the project, for steps that don't run a command
+func (p ComposeProject) logf(step string, format string, args ...interface{}) {
+	p.Output.Line(OutputLine{Time: time.Now(), Subdomain: p.Subdomain, Step: step, Stream: "stdout", Line: fmt.Sprintf(format, args...)})
+}
+
+// swapContainers replaces the running containers of the routed services with ones built from the new image, one
+// service after the other, then brings the rest of the project up to date. Services that aren't running yet are
+// started with the rest and health checked after.
+func swapContainers(runner ComposeRunner, project ComposeProject, services []string, checks map[string]HealthCheck) error {
+	var started []string
+	for _, service := range services {
+		running, err := swapService(runner, project, service, checks[service])
+		if err != nil {
+			return err
+		}
+		if !running {
+			project.logf("swap", "Service %s is not running, starting it", service)
+			started = append(started, service)
+		}
+	}
+	// the remaining services are brought up to date the usual way, the routed ones already are
+	if err := runner.Up(project); err != nil {
+		return err
+	}
+	for _, service := range started {
+		if err := checkServiceHealth(runner, project, service, checks[service]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapService replaces the running containers of service with one built from the new image. The new container is
+// started next to the old ones, so Traefik routes to both while it comes up, and the old ones are only removed once it
+// passes the health check. If it doesn't, it is removed instead and the old containers keep serving. It returns false
+// without doing anything when the service has no running container to replace.
+func swapService(runner ComposeRunner, project ComposeProject, service string, check HealthCheck) (bool, error) {
+	quiet := project
+	quiet.Output = nil
+
+	containers, err := runner.Ps(quiet)
+	if err != nil {
+		return false, err
+	}
+	old := make(map[string]bool)
+	for _, container := range containers {
+		if container.Service == service && container.State == "running" {
+			old[container.ID] = true
+		}
+	}
+	if len(old) == 0 {
+		return false, nil
+	}
+
+	project.logf("swap", "Starting a new %s container next to the %d running", service, len(old))
+	if err := runner.Scale(project, service, len(old)+1); err != nil {
+		return true, err
+	}
+	containers, err = runner.Ps(quiet)
+	if err != nil {
+		return true, err
+	}
+	newID := ""
+	for _, container := range containers {
+		if container.Service == service && !old[container.ID] {
+			newID = container.ID
+		}
+	}
+	if newID == "" {
+		return true, fmt.Errorf("no new %s container was started", service)
+	}
+
+	if err := waitForHealthy(runner, project, service, newID, check); err != nil {
+		project.logf("swap", "New %s container did not come up, removing it and keeping the running version", service)
+		if removeErr := runner.RemoveContainer(project, newID); removeErr != nil {
+			return true, fmt.Errorf("%v, and failed to remove the new container: %v", err, removeErr)
+		}
+		return true, err
+	}
+
+	for id := range old {
+		project.logf("swap", "Removing old %s container %s", service, shortContainerID(id))
+		if err := runner.RemoveContainer(project, id); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func shortContainerID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
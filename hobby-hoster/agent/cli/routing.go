@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// RoutedService is a service with hobby-hoster.enable=true, which Traefik routes a hostname of the project to
+type RoutedService struct {
+	Name string
+	// Prefix comes from the hobby-hoster.subdomain (or hobby-hoster.host-prefix) label: the service is reachable on
+	// <prefix>.<subdomain>.<domain>. The one service without a prefix gets the bare <subdomain>.<domain>.
+	Prefix     string
+	Definition map[interface{}]interface{}
+	// Metadata are the service's own hobby-hoster labels, e.g. its port
+	Metadata map[string]string
+}
+
+// routerName names the Traefik router and service of the routed service. Router names are global in Traefik, an
+// underscore can't be part of a subdomain, so <subdomain>_<prefix> never clashes with another project's routers.
+func (s RoutedService) routerName(subdomain string) string {
+	if s.Prefix == "" {
+		return subdomain
+	}
+	return subdomain + "_" + s.Prefix
+}
+
+func (s RoutedService) host(subdomain string, domain string) string {
+	if s.Prefix == "" {
+		return fmt.Sprintf("%s.%s", subdomain, domain)
+	}
+	return fmt.Sprintf("%s.%s.%s", s.Prefix, subdomain, domain)
+}
+
+// getRoutedServices returns the services with hobby-hoster.enable=true, sorted by name. At most one of them may
+// claim the bare subdomain, the others need distinct prefixes.
+func getRoutedServices(fullProjectDir string) ([]RoutedService, error) {
+	services, err := getComposeServices(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+	env, err := readDotEnv(fullProjectDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var routed []RoutedService
+	prefixes := make(map[string]string)
+	for name, service := range services {
+		serviceMap, ok := service.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		metadata, err := getServiceHobbyHosterLabels(serviceMap, env)
+		if err != nil {
+			return nil, fmt.Errorf("service %v: %v", name, err)
+		}
+		if metadata["enable"] != "true" {
+			continue
+		}
+
+		prefix := metadata["subdomain"]
+		if hostPrefix, ok := metadata["host-prefix"]; ok {
+			if prefix != "" && prefix != hostPrefix {
+				return nil, fmt.Errorf("service %v sets both hobby-hoster.subdomain and hobby-hoster.host-prefix", name)
+			}
+			prefix = hostPrefix
+		}
+		if prefix != "" && !isValidSubdomain(prefix) {
+			return nil, fmt.Errorf("invalid hobby-hoster.subdomain %q of service %v", prefix, name)
+		}
+		if other, taken := prefixes[prefix]; taken {
+			if prefix == "" {
+				return nil, fmt.Errorf("services %s and %v both claim the bare subdomain, give all but one of them a hobby-hoster.subdomain label", other, name)
+			}
+			return nil, fmt.Errorf("services %s and %v both use hobby-hoster.subdomain %q", other, name, prefix)
+		}
+		prefixes[prefix] = fmt.Sprint(name)
+		routed = append(routed, RoutedService{Name: fmt.Sprint(name), Prefix: prefix, Definition: serviceMap, Metadata: metadata})
+	}
+	if len(routed) == 0 {
+		return nil, errors.New("No services with 'hobby-hoster.enable=true' found in the compose file")
+	}
+	sort.Slice(routed, func(i, k int) bool { return routed[i].Name < routed[k].Name })
+	return routed, nil
+}
+
+// getTraefikLabels returns the labels that route each routed service's hostname to it. The extra labels go to the
+// service on the bare subdomain, or to the first routed service when none of them is.
+func getTraefikLabels(domain string, subdomain string, routed []RoutedService, extraTraefikLabels []string) (map[string][]string, error) {
+	labels := make(map[string][]string)
+	extraLabelsService := routed[0].Name
+	for _, service := range routed {
+		port := "80" // Default port
+		if val, ok := service.Metadata["port"]; ok {
+			port = val
+		}
+
+		private := false
+		if val, ok := service.Metadata["private"]; ok {
+			var err error
+			private, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		router := service.routerName(subdomain)
+		serviceLabels := []string{
+			"traefik.enable=true",
+			fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`)", router, service.host(subdomain, domain)),
+			fmt.Sprintf("traefik.http.routers.%s.entrypoints=websecure", router),
+			fmt.Sprintf("traefik.http.routers.%s.tls=true", router),
+			fmt.Sprintf("traefik.http.routers.%s.tls.certresolver=le", router),
+			fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port=%s", router, port),
+			// the service can be on networks of its own, Traefik can only reach it on this one
+			"traefik.docker.network=traefik-public",
+		}
+
+		if private {
+			serviceLabels = append(serviceLabels, fmt.Sprintf("traefik.http.routers.%s.middlewares=auth", router))
+		}
+		labels[service.Name] = serviceLabels
+		if service.Prefix == "" {
+			extraLabelsService = service.Name
+		}
+	}
+	labels[extraLabelsService] = append(labels[extraLabelsService], extraTraefikLabels...)
+	return labels, nil
+}
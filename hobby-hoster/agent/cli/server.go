@@ -0,0 +1,558 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// API_VERSION_PREFIX is prepended to every management API route. Breaking changes to the API get a new prefix.
+const API_VERSION_PREFIX = "/v1"
+
+type apiServer struct {
+	token string
+	mux   *http.ServeMux
+}
+
+func newAPIServer(token string, githubWebhooks *githubWebhookHandler) *apiServer {
+	s := &apiServer{token: token, mux: http.NewServeMux()}
+	s.mux.Handle(API_VERSION_PREFIX+"/webhooks/github", githubWebhooks)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/services", s.handleServices)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/services/", s.handleService)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/rebuild", s.handleRebuild)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/clone", s.handleClone)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/apply", s.handleApply)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/drift", s.handleDrift)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/polls", s.handlePolls)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/status", s.handleStatus)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/usage", s.handleUsage)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/ports", s.handlePorts)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/jobs", s.handleJobs)
+	s.mux.HandleFunc(API_VERSION_PREFIX+"/jobs/", s.handleJob)
+	return s
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// webhooks authenticate with their own signatures
+	if s.token != "" && !strings.HasPrefix(r.URL.Path, API_VERSION_PREFIX+"/webhooks/") {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(s.token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+	}
+	start := time.Now()
+	s.mux.ServeHTTP(w, r)
+	log.Printf("%s %s (%v)", r.Method, r.URL.Path, time.Since(start))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError uses the same {"error": "..."} shape the CLI prints when run with --json.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]interface{}{"error": err.Error()})
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	if r.Body == nil || r.ContentLength == 0 {
+		return nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed, use %s", strings.Join(allowed, " or ")))
+}
+
+// GET /v1/services
+func (s *apiServer) handleServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	services, err := listServices()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, services)
+}
+
+// POST   /v1/services/{subdomain}/clone
+// POST   /v1/services/{subdomain}/rebuild
+// GET    /v1/services/{subdomain}/logs
+// GET    /v1/services/{subdomain}/usage
+// DELETE /v1/services/{subdomain}
+func (s *apiServer) handleService(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, API_VERSION_PREFIX+"/services/"), "/"), "/")
+	subdomain := parts[0]
+	if subdomain == "" || !isValidSubdomain(subdomain) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid subdomain: %q", subdomain))
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = strings.Join(parts[1:], "/")
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		s.run(w, r, JobKindRemove, []string{subdomain})
+	case "clone":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var body struct {
+			Repo string `json:"repo"`
+		}
+		if err := decodeBody(r, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if body.Repo == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("'repo' is required"))
+			return
+		}
+		s.run(w, r, JobKindClone, []cloneTarget{{Repo: body.Repo, Subdomain: subdomain}})
+	case "rebuild":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var body struct {
+			Domain             string   `json:"domain"`
+			ExtraTraefikLabels []string `json:"extra_traefik_labels"`
+		}
+		if err := decodeBody(r, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if body.Domain == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("'domain' is required"))
+			return
+		}
+		input := rebuildInput{
+			Domain:     body.Domain,
+			Subdomains: []rebuildSubdomain{{Subdomain: subdomain, ExtraTraefikLabels: body.ExtraTraefikLabels}},
+		}
+		s.run(w, r, JobKindRebuild, rebuildRequest{rebuildInput: input})
+	case "logs":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.handleLogs(w, r, subdomain)
+	case "usage":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		since, err := parseSince(usageSinceParam(r))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		samples, err := loadUsage(subdomain, since)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"summary": summarizeUsage(subdomain, samples), "samples": samples})
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown action: %s", action))
+	}
+}
+
+// handleLogs responds with one JSON object per log line (application/x-ndjson), flushed as lines arrive so
+// ?follow=true can be read as a stream. ?service, ?since and ?tail work like the flags of the logs command.
+func (s *apiServer) handleLogs(w http.ResponseWriter, r *http.Request, subdomain string) {
+	query := r.URL.Query()
+	follow, _ := strconv.ParseBool(query.Get("follow"))
+	since, err := parseSince(query.Get("since"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	tail, err := parseTail(query.Get("tail"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	started := false
+	encoder := json.NewEncoder(w)
+	err = streamLogs(r.Context(), subdomain, query.Get("service"), LogOptions{Follow: follow, Since: since, Tail: tail}, func(line LogLine) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		encoder.Encode(line)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil && !started {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err != nil {
+		// the status is already sent, the error ends the stream as its last object
+		encoder.Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if !started {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// run executes the operation before responding, or enqueues it as a job when the request has ?async=true.
+// Async requests get a 202 with the job ID which can be followed through /v1/jobs/{id}.
+// With ?stream=true the response is a stream of Server-Sent Events: a "line" event per line of command output
+// and a final "result" event with the usual JSON body.
+func (s *apiServer) run(w http.ResponseWriter, r *http.Request, kind string, input interface{}) {
+	if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+		job, err := newJob(kind, input)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		go func() {
+			if err := runJob(job); err != nil {
+				log.Printf("Failed to run job %s: %v", job.ID, err)
+			}
+		}()
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"job_id": job.ID, "state": job.State})
+		return
+	}
+
+	rawInput, err := json.Marshal(input)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if stream, _ := strconv.ParseBool(r.URL.Query().Get("stream")); stream {
+		events, err := newSSEWriter(w)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		out := NewOpOutput(nil).OnLine(func(line OutputLine) {
+			events.Send("line", line)
+		})
+		events.Send("result", resultJSON(executeJobLocked(kind, rawInput, out)))
+		return
+	}
+
+	result, errs := executeJobLocked(kind, rawInput, nil)
+	if len(errs) > 0 {
+		writeJSON(w, http.StatusInternalServerError, resultJSON(result, errs))
+		return
+	}
+	writeJSON(w, http.StatusOK, resultJSON(result, errs))
+}
+
+// GET /v1/jobs
+func (s *apiServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	jobs, err := listJobs()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// GET /v1/jobs/{id}
+// GET /v1/jobs/{id}/events streams the job's output as Server-Sent Events ("line" events, then one "result" event with the job)
+func (s *apiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, API_VERSION_PREFIX+"/jobs/"), "/"), "/")
+	job, err := loadJob(id)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+
+	switch action {
+	case "":
+		writeJSON(w, http.StatusOK, job)
+	case "events":
+		events, err := newSSEWriter(w)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		job, err = followJob(id, r.Context().Done(), func(line OutputLine) {
+			events.Send("line", line)
+		})
+		if err != nil {
+			events.Send("result", map[string]interface{}{"error": err.Error()})
+			return
+		}
+		events.Send("result", job)
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown action: %s", action))
+	}
+}
+
+// POST /v1/rebuild takes the same JSON document as the rebuild command, plus an optional "parallel" field.
+func (s *apiServer) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var body rebuildRequest
+	if err := decodeBody(r, &body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, subdomain := range body.Subdomains {
+		if !isValidSubdomain(subdomain.Subdomain) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid subdomain: %q", subdomain.Subdomain))
+			return
+		}
+	}
+	s.run(w, r, JobKindRebuild, body)
+}
+
+// POST /v1/apply takes the desired state the apply command takes. With ?dry_run=true only the plan is returned.
+func (s *apiServer) handleApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var state DesiredState
+	if err := decodeBody(r, &state); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := state.normalize(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun {
+		plan, errs := applyDesiredState(state, true, nil)
+		if len(errs) > 0 {
+			writeJSON(w, http.StatusInternalServerError, resultJSON(nil, errs))
+			return
+		}
+		writeJSON(w, http.StatusOK, resultJSON(map[string]interface{}{"plan": plan}, nil))
+		return
+	}
+	s.run(w, r, JobKindApply, state)
+}
+
+// GET /v1/drift reports drift without repairing anything, ?last=true returns the last reconciler report instead
+func (s *apiServer) handleDrift(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if last, _ := strconv.ParseBool(r.URL.Query().Get("last")); last {
+		summary, err := loadLastDriftSummary()
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, summary)
+		return
+	}
+	summary, err := reconcile(false, nil)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// GET /v1/polls returns every recorded poll result per subdomain, oldest first
+func (s *apiServer) handlePolls(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	status, err := loadPollStatus()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// GET /v1/status reports every deployed project, ?subdomain=a&subdomain=b only the given ones
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	statuses, err := getProjectStatuses(r.URL.Query()["subdomain"])
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// GET /v1/ports lists the host ports allocated to every project, ?subdomain=a&subdomain=b only to the given ones
+func (s *apiServer) handlePorts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	allocations, err := getPortAllocations(r.URL.Query()["subdomain"])
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, allocations)
+}
+
+// GET /v1/usage summarizes the usage of every project, ?since works like the flag of the usage command
+func (s *apiServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	since, err := parseSince(usageSinceParam(r))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	summaries, err := getUsageSummaries(since)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func usageSinceParam(r *http.Request) string {
+	if since := r.URL.Query().Get("since"); since != "" {
+		return since
+	}
+	return "24h"
+}
+
+// POST /v1/clone takes a list of {"repo": "...", "subdomain": "..."} objects, mirroring the pairs given to the clone command.
+func (s *apiServer) handleClone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var targets []cloneTarget
+	if err := decodeBody(r, &targets); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, target := range targets {
+		if !isValidSubdomain(target.Subdomain) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid subdomain: %q", target.Subdomain))
+			return
+		}
+	}
+	s.run(w, r, JobKindClone, targets)
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the agent as a daemon",
+	Long:  `This command runs the agent as a long running daemon and exposes the management commands as a versioned HTTP API.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen, _ := cmd.Flags().GetString("listen")
+		token, _ := cmd.Flags().GetString("token")
+		if token == "" {
+			token = os.Getenv("HOBBY_HOSTER_AGENT_TOKEN")
+		}
+		if token == "" && !strings.HasPrefix(listen, "127.0.0.1:") && !strings.HasPrefix(listen, "localhost:") {
+			log.Printf("WARNING: management API is listening on %s without a token", listen)
+		}
+
+		if err := checkComposeVersion(getComposeRunner(), ComposeProject{Dir: "/"}); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+
+		reconcileInterval, _ := cmd.Flags().GetDuration("reconcile-interval")
+		if reconcileInterval > 0 {
+			log.Printf("Reconciler running every %v", reconcileInterval)
+			go runReconciler(reconcileInterval)
+		}
+
+		webhookDebounce, _ := cmd.Flags().GetDuration("webhook-debounce")
+		webhookMaxAge, _ := cmd.Flags().GetDuration("webhook-max-age")
+		// webhooks and the poller share the debouncer so a project is never deployed by both at once
+		debouncer := newDeployDebouncer(webhookDebounce)
+		webhooks := &githubWebhookHandler{
+			deliveries: &webhookDeliveries{},
+			debouncer:  debouncer,
+			maxAge:     webhookMaxAge,
+		}
+		go newProjectPoller(debouncer).run(5 * time.Second)
+
+		usageInterval, _ := cmd.Flags().GetDuration("usage-interval")
+		usageRetention, _ := cmd.Flags().GetDuration("usage-retention")
+		if usageInterval > 0 {
+			go runUsageSampler(usageInterval, usageRetention)
+		}
+
+		if jobRetention, _ := cmd.Flags().GetDuration("job-retention"); jobRetention > 0 {
+			go runJobPruner(jobRetention)
+		}
+
+		gcInterval, _ := cmd.Flags().GetDuration("gc-interval")
+		if gcInterval > 0 {
+			gcKeep, _ := cmd.Flags().GetInt("gc-keep")
+			gcBudgetFlag, _ := cmd.Flags().GetString("gc-build-cache-budget")
+			gcBudget, err := parseBuildCacheBudget(gcBudgetFlag)
+			if err != nil {
+				return err
+			}
+			if gcKeep < 1 {
+				return errors.New("--gc-keep must be at least 1, the current image of a service is always kept")
+			}
+			log.Printf("Garbage collector running every %v", gcInterval)
+			go runGarbageCollector(gcInterval, GCOptions{Keep: gcKeep, BuildCacheBudget: gcBudget})
+		}
+
+		server := &http.Server{
+			Addr:              listen,
+			Handler:           newAPIServer(token, webhooks),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		log.Printf("Management API listening on %s", listen)
+		return server.ListenAndServe()
+	},
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ContainerStatus is the runtime state of a container as reported by the status command
+type ContainerStatus struct {
+	ContainerInfo
+	// UptimeSeconds is how long the container has been running, 0 when it isn't
+	UptimeSeconds int64 `json:"uptime_seconds"`
+}
+
+type ProjectStatus struct {
+	Subdomain  string            `json:"subdomain"`
+	Containers []ContainerStatus `json:"containers"`
+	// Error is set when the containers of the project could not be listed
+	Error string `json:"error,omitempty"`
+}
+
+func getProjectStatus(subdomain string) ProjectStatus {
+	status := ProjectStatus{Subdomain: subdomain, Containers: []ContainerStatus{}}
+	if !isValidSubdomain(subdomain) {
+		status.Error = fmt.Sprintf("invalid subdomain: %q", subdomain)
+		return status
+	}
+	if _, err := os.Stat(getProjectPath(subdomain)); os.IsNotExist(err) {
+		status.Error = fmt.Sprintf("Project directory does not exist: %v", err)
+		return status
+	}
+
+	runner := getComposeRunner()
+	project := newComposeProject(subdomain, nil)
+	containers, err := runner.Ps(project)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	for _, container := range containers {
+		info, err := runner.InspectContainer(project, container.ID)
+		if isDockerNotFound(err) {
+			// removed since it was listed
+			continue
+		} else if err != nil {
+			status.Error = err.Error()
+			return status
+		}
+		containerStatus := ContainerStatus{ContainerInfo: *info}
+		if info.State == "running" && !info.StartedAt.IsZero() {
+			containerStatus.UptimeSeconds = int64(time.Since(info.StartedAt).Seconds())
+		}
+		status.Containers = append(status.Containers, containerStatus)
+	}
+	return status
+}
+
+// getProjectStatuses returns the status of the given projects, or of every deployed one when none are given
+func getProjectStatuses(subdomains []string) ([]ProjectStatus, error) {
+	if len(subdomains) == 0 {
+		services, err := listServices()
+		if err != nil {
+			return nil, err
+		}
+		for _, service := range services {
+			subdomains = append(subdomains, service.Subdomain)
+		}
+	}
+	statuses := []ProjectStatus{}
+	for _, subdomain := range subdomains {
+		statuses = append(statuses, getProjectStatus(subdomain))
+	}
+	return statuses, nil
+}
+
+// formatUptime shortens a duration to its two largest units, e.g. 3d4h or 12m5s
+func formatUptime(seconds int64) string {
+	days, hours, minutes := seconds/86400, seconds%86400/3600, seconds%3600/60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("%dm%ds", minutes, seconds%60)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
+
+func printProjectStatuses(statuses []ProjectStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBDOMAIN\tCONTAINER\tSTATE\tHEALTH\tUPTIME\tRESTARTS\tIMAGE\tPORTS\tROUTER")
+	for _, status := range statuses {
+		if status.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", status.Subdomain, status.Error)
+			continue
+		}
+		if len(status.Containers) == 0 {
+			fmt.Fprintf(w, "%s\t-\tnot running\n", status.Subdomain)
+			continue
+		}
+		for _, container := range status.Containers {
+			health, uptime, ports, routers := "-", "-", []string{}, []string{}
+			if container.Health != "" {
+				health = container.Health
+			}
+			if container.UptimeSeconds > 0 {
+				uptime = formatUptime(container.UptimeSeconds)
+			}
+			for _, port := range container.Ports {
+				ports = append(ports, fmt.Sprintf("%s->%s", port.HostPort, port.ContainerPort))
+			}
+			for _, router := range container.Routers {
+				routers = append(routers, fmt.Sprintf("%s %s", router.Name, router.Rule))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", status.Subdomain, container.Name, container.State, health, uptime,
+				container.RestartCount, container.Image, orDash(strings.Join(ports, ",")), orDash(strings.Join(routers, ",")))
+		}
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status [subdomain...]",
+	Short: "Show the runtime state of projects",
+	Long:  `This command shows every container of the given projects (all of them by default) with its state, health, uptime, restart count, image, published ports and the Traefik router it is attached to.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		statuses, err := getProjectStatuses(args)
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		if jsonOutput {
+			statusesJson, _ := json.Marshal(statuses)
+			fmt.Println(string(statusesJson))
+			return nil
+		}
+		printProjectStatuses(statuses)
+		var errs []string
+		for _, status := range statuses {
+			if status.Error != "" {
+				errs = append(errs, fmt.Sprintf("%s: %s", status.Subdomain, status.Error))
+			}
+		}
+		if len(errs) > 0 {
+			return errors.New(fmt.Sprintf("Encountered errors during status: %v", errs))
+		}
+		return nil
+	},
+}
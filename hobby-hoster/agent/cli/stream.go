@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func formatOutputLine(line OutputLine) string {
+	return fmt.Sprintf("[%s] %s | %s", line.Subdomain, line.Step, line.Line)
+}
+
+// newCLIOutput returns the output synchronous commands run with so progress is visible while they run.
+// Human output streams every line to the terminal. With --json nothing is streamed unless --stream is given,
+// in which case each line is printed as a JSON object before the usual result object, one object per line.
+func newCLIOutput(cmd *cobra.Command) *OpOutput {
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	stream, _ := cmd.Flags().GetBool("stream")
+
+	if jsonOutput {
+		if !stream {
+			return nil
+		}
+		return NewOpOutput(nil).OnLine(func(line OutputLine) {
+			lineJson, _ := json.Marshal(map[string]interface{}{"type": "line", "line": line})
+			fmt.Println(string(lineJson))
+		})
+	}
+
+	return NewOpOutput(nil).OnLine(func(line OutputLine) {
+		if line.Stream == "stderr" {
+			fmt.Fprintln(os.Stderr, formatOutputLine(line))
+		} else {
+			fmt.Println(formatOutputLine(line))
+		}
+	})
+}
+
+func getJobLinesPath(id string) string {
+	return filepath.Join(JOBS_DIR, id+".lines.jsonl")
+}
+
+// jobLinesWriter appends every streamed line of a job to a file next to the job record,
+// which is what lets `jobs wait` and the events endpoint follow a job run by another process.
+func jobLinesWriter(job *Job) (func(OutputLine), io.Closer, error) {
+	if err := os.MkdirAll(JOBS_DIR, 0755); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(getJobLinesPath(job.ID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(line OutputLine) {
+		lineJson, _ := json.Marshal(line)
+		file.Write(append(lineJson, '\n'))
+	}, file, nil
+}
+
+// readJobLines returns the lines written to the job's lines file after offset and the offset to continue from.
+// A partially written last line is left for the next call.
+func readJobLines(id string, offset int64) ([]OutputLine, int64, error) {
+	file, err := os.Open(getJobLinesPath(id))
+	if os.IsNotExist(err) {
+		return nil, offset, nil
+	} else if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	var lines []OutputLine
+	reader := bufio.NewReader(file)
+	for {
+		raw, err := reader.ReadBytes('\n')
+		if err != nil {
+			// io.EOF, possibly with a partial line we will read again next time
+			break
+		}
+		offset += int64(len(raw))
+		var line OutputLine
+		if json.Unmarshal(raw, &line) == nil {
+			lines = append(lines, line)
+		}
+	}
+	return lines, offset, nil
+}
+
+// followJob calls onLine for every line of the job until it is done, then returns the finished job
+func followJob(id string, stop <-chan struct{}, onLine func(OutputLine)) (*Job, error) {
+	var offset int64
+	for {
+		// load the job before reading lines so nothing written before it finished is missed
+		job, err := loadJob(id)
+		if err != nil {
+			return nil, err
+		}
+		var lines []OutputLine
+		lines, offset, err = readJobLines(id, offset)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			onLine(line)
+		}
+		if job.Done() {
+			return job, nil
+		}
+		select {
+		case <-stop:
+			return job, nil
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// sseWriter writes Server-Sent Events to an HTTP response
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming is not supported by this connection")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseWriter{w: w, flusher: flusher}, nil
+}
+
+func (s *sseWriter) Send(event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	s.flusher.Flush()
+}
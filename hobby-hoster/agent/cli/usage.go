@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// the sampled resource usage of every project, one file per project and day so old days can simply be deleted
+var USAGE_DIR = "/mnt/data/usage"
+
+// ContainerUsage is a sample of the resource usage of one container. The network and block I/O are counted since the container started.
+type ContainerUsage struct {
+	ID              string  `json:"id"`
+	Name            string  `json:"name"`
+	Service         string  `json:"service"`
+	CPUPercent      float64 `json:"cpu_percent"`
+	MemoryBytes     int64   `json:"memory_bytes"`
+	NetRxBytes      int64   `json:"net_rx_bytes"`
+	NetTxBytes      int64   `json:"net_tx_bytes"`
+	BlockReadBytes  int64   `json:"block_read_bytes"`
+	BlockWriteBytes int64   `json:"block_write_bytes"`
+}
+
+// UsageSample is the usage of all running containers of a project at one point in time
+type UsageSample struct {
+	Time       time.Time `json:"time"`
+	Containers int       `json:"containers"`
+	// CPUPercent is relative to one CPU, a project using two CPUs fully is at 200
+	CPUPercent      float64 `json:"cpu_percent"`
+	MemoryBytes     int64   `json:"memory_bytes"`
+	NetRxBytes      int64   `json:"net_rx_bytes"`
+	NetTxBytes      int64   `json:"net_tx_bytes"`
+	BlockReadBytes  int64   `json:"block_read_bytes"`
+	BlockWriteBytes int64   `json:"block_write_bytes"`
+}
+
+// UsageSummary describes the usage of a project over a period
+type UsageSummary struct {
+	Subdomain      string    `json:"subdomain"`
+	Samples        int       `json:"samples"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	AvgCPUPercent  float64   `json:"avg_cpu_percent"`
+	MaxCPUPercent  float64   `json:"max_cpu_percent"`
+	AvgMemoryBytes int64     `json:"avg_memory_bytes"`
+	MaxMemoryBytes int64     `json:"max_memory_bytes"`
+	// the traffic and disk I/O during the period
+	NetRxBytes      int64 `json:"net_rx_bytes"`
+	NetTxBytes      int64 `json:"net_tx_bytes"`
+	BlockReadBytes  int64 `json:"block_read_bytes"`
+	BlockWriteBytes int64 `json:"block_write_bytes"`
+}
+
+var dockerSizeUnits = map[string]float64{
+	"b":  1,
+	"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+}
+
+// parseDockerSize parses the sizes docker stats prints, decimal (kB, MB) for I/O and binary (KiB, MiB) for memory
+func parseDockerSize(size string) int64 {
+	size = strings.TrimSpace(size)
+	i := strings.IndexFunc(size, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(size)
+	}
+	value, err := strconv.ParseFloat(size[:i], 64)
+	if err != nil {
+		return 0
+	}
+	multiplier, ok := dockerSizeUnits[strings.ToLower(strings.TrimSpace(size[i:]))]
+	if !ok {
+		multiplier = 1
+	}
+	return int64(value * multiplier)
+}
+
+// parseDockerSizePair parses "used / limit" and "in / out" columns of docker stats
+func parseDockerSizePair(pair string) (int64, int64) {
+	first, second, _ := strings.Cut(pair, "/")
+	return parseDockerSize(first), parseDockerSize(second)
+}
+
+func newUsageSample(at time.Time, usages []ContainerUsage) UsageSample {
+	sample := UsageSample{Time: at, Containers: len(usages)}
+	for _, usage := range usages {
+		sample.CPUPercent += usage.CPUPercent
+		sample.MemoryBytes += usage.MemoryBytes
+		sample.NetRxBytes += usage.NetRxBytes
+		sample.NetTxBytes += usage.NetTxBytes
+		sample.BlockReadBytes += usage.BlockReadBytes
+		sample.BlockWriteBytes += usage.BlockWriteBytes
+	}
+	return sample
+}
+
+func getUsagePath(subdomain string, day time.Time) string {
+	return filepath.Join(USAGE_DIR, subdomain, day.UTC().Format("2006-01-02")+".jsonl")
+}
+
+func appendUsageSample(subdomain string, sample UsageSample) error {
+	path := getUsagePath(subdomain, sample.Time)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	sampleJson, _ := json.Marshal(sample)
+	if _, err := file.Write(append(sampleJson, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// loadUsage returns the samples of a project taken since the given time, oldest first
+func loadUsage(subdomain string, since time.Time) ([]UsageSample, error) {
+	files, err := os.ReadDir(filepath.Join(USAGE_DIR, subdomain))
+	if os.IsNotExist(err) {
+		return []UsageSample{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	samples := []UsageSample{}
+	for _, f := range files {
+		day, err := time.Parse("2006-01-02", strings.TrimSuffix(f.Name(), ".jsonl"))
+		if err != nil || day.Add(24*time.Hour).Before(since) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(USAGE_DIR, subdomain, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var sample UsageSample
+			// a line cut short by a crash is skipped
+			if json.Unmarshal(scanner.Bytes(), &sample) == nil && !sample.Time.Before(since) {
+				samples = append(samples, sample)
+			}
+		}
+		file.Close()
+	}
+	sort.SliceStable(samples, func(i, k int) bool { return samples[i].Time.Before(samples[k].Time) })
+	return samples, nil
+}
+
+// pruneUsage deletes the days that are entirely older than the retention, including those of removed projects
+func pruneUsage(retention time.Duration) error {
+	projects, err := os.ReadDir(USAGE_DIR)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	for _, project := range projects {
+		projectDir := filepath.Join(USAGE_DIR, project.Name())
+		files, err := os.ReadDir(projectDir)
+		if err != nil {
+			return err
+		}
+		kept := 0
+		for _, f := range files {
+			day, err := time.Parse("2006-01-02", strings.TrimSuffix(f.Name(), ".jsonl"))
+			if err == nil && day.Add(24*time.Hour).Before(cutoff) {
+				if err := os.Remove(filepath.Join(projectDir, f.Name())); err != nil {
+					return err
+				}
+				continue
+			}
+			kept++
+		}
+		if kept == 0 {
+			os.Remove(projectDir)
+		}
+	}
+	return nil
+}
+
+// sampleUsage records a sample of every deployed project
+func sampleUsage() error {
+	services, err := listServices()
+	if err != nil {
+		return err
+	}
+	runner := getComposeRunner()
+	for _, service := range services {
+		at := time.Now().UTC()
+		usages, err := runner.Stats(newComposeProject(service.Subdomain, nil))
+		if err != nil {
+			log.Printf("Usage: failed to sample %s: %v", service.Subdomain, err)
+			continue
+		}
+		if err := appendUsageSample(service.Subdomain, newUsageSample(at, usages)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runUsageSampler samples every interval and drops samples older than retention
+func runUsageSampler(interval time.Duration, retention time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := sampleUsage(); err != nil {
+			log.Printf("Usage: %v", err)
+		}
+		if err := pruneUsage(retention); err != nil {
+			log.Printf("Usage: failed to prune old samples: %v", err)
+		}
+	}
+}
+
+// counterDelta adds up how much a counter grew between samples. Counters restart when containers are recreated,
+// after which the new value is all growth.
+func counterDelta(samples []UsageSample, counter func(UsageSample) int64) int64 {
+	var total int64
+	for i := 1; i < len(samples); i++ {
+		previous, current := counter(samples[i-1]), counter(samples[i])
+		if current >= previous {
+			total += current - previous
+		} else {
+			total += current
+		}
+	}
+	return total
+}
+
+func summarizeUsage(subdomain string, samples []UsageSample) UsageSummary {
+	summary := UsageSummary{Subdomain: subdomain, Samples: len(samples)}
+	if len(samples) == 0 {
+		return summary
+	}
+	summary.From = samples[0].Time
+	summary.To = samples[len(samples)-1].Time
+	var cpuTotal float64
+	var memoryTotal int64
+	for _, sample := range samples {
+		cpuTotal += sample.CPUPercent
+		memoryTotal += sample.MemoryBytes
+		if sample.CPUPercent > summary.MaxCPUPercent {
+			summary.MaxCPUPercent = sample.CPUPercent
+		}
+		if sample.MemoryBytes > summary.MaxMemoryBytes {
+			summary.MaxMemoryBytes = sample.MemoryBytes
+		}
+	}
+	summary.AvgCPUPercent = cpuTotal / float64(len(samples))
+	summary.AvgMemoryBytes = memoryTotal / int64(len(samples))
+	summary.NetRxBytes = counterDelta(samples, func(s UsageSample) int64 { return s.NetRxBytes })
+	summary.NetTxBytes = counterDelta(samples, func(s UsageSample) int64 { return s.NetTxBytes })
+	summary.BlockReadBytes = counterDelta(samples, func(s UsageSample) int64 { return s.BlockReadBytes })
+	summary.BlockWriteBytes = counterDelta(samples, func(s UsageSample) int64 { return s.BlockWriteBytes })
+	return summary
+}
+
+// getUsageSummaries summarizes every deployed project, the heaviest memory users first
+func getUsageSummaries(since time.Time) ([]UsageSummary, error) {
+	services, err := listServices()
+	if err != nil {
+		return nil, err
+	}
+	summaries := []UsageSummary{}
+	for _, service := range services {
+		samples, err := loadUsage(service.Subdomain, since)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summarizeUsage(service.Subdomain, samples))
+	}
+	sort.SliceStable(summaries, func(i, k int) bool { return summaries[i].AvgMemoryBytes > summaries[k].AvgMemoryBytes })
+	return summaries, nil
+}
+
+// formatBytes formats a size with a binary unit, e.g. 1.5GiB
+func formatBytes(bytes int64) string {
+	value := float64(bytes)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if value < 1024 {
+			return strconv.FormatFloat(value, 'f', 1, 64) + unit
+		}
+		value /= 1024
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + "TiB"
+}
+
+func printUsageSummaries(summaries []UsageSummary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBDOMAIN\tSAMPLES\tCPU AVG\tCPU MAX\tMEM AVG\tMEM MAX\tNET IN\tNET OUT\tDISK READ\tDISK WRITE")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t%.1f%%\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Subdomain, s.Samples, s.AvgCPUPercent, s.MaxCPUPercent,
+			formatBytes(s.AvgMemoryBytes), formatBytes(s.MaxMemoryBytes), formatBytes(s.NetRxBytes), formatBytes(s.NetTxBytes),
+			formatBytes(s.BlockReadBytes), formatBytes(s.BlockWriteBytes))
+	}
+	w.Flush()
+}
+
+var usageCmd = &cobra.Command{
+	Use:   "usage [subdomain]",
+	Short: "Show the resource usage history of projects",
+	Long:  `This command summarizes the CPU, memory, network and disk usage sampled by the daemon (serve --usage-interval) since --since, for one project along with its samples, or for every project with the heaviest memory users first.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		sinceFlag, _ := cmd.Flags().GetString("since")
+		printError := func(err error) error {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		since, err := parseSince(sinceFlag)
+		if err != nil {
+			return printError(err)
+		}
+
+		if len(args) == 0 {
+			summaries, err := getUsageSummaries(since)
+			if err != nil {
+				return printError(err)
+			}
+			if jsonOutput {
+				summariesJson, _ := json.Marshal(summaries)
+				fmt.Println(string(summariesJson))
+				return nil
+			}
+			printUsageSummaries(summaries)
+			return nil
+		}
+
+		if !isValidSubdomain(args[0]) {
+			return printError(fmt.Errorf("invalid subdomain: %q", args[0]))
+		}
+		samples, err := loadUsage(args[0], since)
+		if err != nil {
+			return printError(err)
+		}
+		summary := summarizeUsage(args[0], samples)
+		if jsonOutput {
+			usageJson, _ := json.Marshal(map[string]interface{}{"summary": summary, "samples": samples})
+			fmt.Println(string(usageJson))
+			return nil
+		}
+		printUsageSummaries([]UsageSummary{summary})
+		return nil
+	},
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var WEBHOOK_SECRETS_FILE = "/mnt/data/webhook-secrets.json"
+var WEBHOOK_DELIVERIES_FILE = "/mnt/data/webhook-deliveries.json"
+
+// lockWebhookSecrets keeps every other agent process (e.g. `webhook-secret --rotate` next to `serve`) and goroutine
+// from changing the secrets until the returned lock is released
+func lockWebhookSecrets() (*fileLock, error) {
+	return lockFile(WEBHOOK_SECRETS_FILE+".lock", true)
+}
+
+// GitHub caps webhook payloads at 25MB
+const MAX_WEBHOOK_PAYLOAD_BYTES = 25 << 20
+
+// deliveries are remembered for this long to reject replays, anything older is rejected as stale anyway
+const WEBHOOK_DELIVERY_RETENTION = 24 * time.Hour
+
+const JobKindDeploy = "deploy"
+
+// deployRequest is the input of a deploy job: clone and rebuild a single project
+type deployRequest struct {
+	Domain  string         `json:"domain"`
+	Project DesiredProject `json:"project"`
+	// Commit is the remote commit that triggered the deploy, the branch is cloned as it is when the deploy runs
+	Commit string `json:"commit,omitempty"`
+}
+
+func loadWebhookSecrets() (map[string]string, error) {
+	secrets := make(map[string]string)
+	data, err := os.ReadFile(WEBHOOK_SECRETS_FILE)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", WEBHOOK_SECRETS_FILE, err)
+	}
+	return secrets, nil
+}
+
+// getOrCreateWebhookSecret returns the webhook secret of a project, generating one if it has none or rotate is set
+func getOrCreateWebhookSecret(subdomain string, rotate bool) (string, error) {
+	lock, err := lockWebhookSecrets()
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	secrets, err := loadWebhookSecrets()
+	if err != nil {
+		return "", err
+	}
+	if secret, ok := secrets[subdomain]; ok && !rotate {
+		return secret, nil
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	secrets[subdomain] = hex.EncodeToString(random)
+
+	data, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// the file holds secrets, keep it private to the agent's user
+	if err := writeFileAtomic(WEBHOOK_SECRETS_FILE, data, 0600); err != nil {
+		return "", err
+	}
+	return secrets[subdomain], nil
+}
+
+// verifyGitHubSignature checks the X-Hub-Signature-256 header, which is the hex HMAC-SHA256 of the body prefixed with "sha256="
+func verifyGitHubSignature(secret string, body []byte, signature string) bool {
+	if secret == "" || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	provided, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(provided, mac.Sum(nil))
+}
+
+// normalizeRepoURL reduces the different ways of writing a repository URL (https, ssh, with or without .git) to host/owner/name
+func normalizeRepoURL(url string) string {
+	url = strings.ToLower(strings.TrimSpace(url))
+	for _, prefix := range []string{"https://", "http://", "ssh://", "git://"} {
+		url = strings.TrimPrefix(url, prefix)
+	}
+	if i := strings.Index(url, "@"); i >= 0 {
+		url = url[i+1:]
+	}
+	url = strings.Replace(url, ":", "/", 1)
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+	return url
+}
+
+type githubPushEvent struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+	// HeadCommit is null when a branch is deleted
+	HeadCommit *struct {
+		Timestamp time.Time `json:"timestamp"`
+	} `json:"head_commit"`
+	Repository struct {
+		FullName      string `json:"full_name"`
+		HTMLURL       string `json:"html_url"`
+		CloneURL      string `json:"clone_url"`
+		SSHURL        string `json:"ssh_url"`
+		DefaultBranch string `json:"default_branch"`
+		// PushedAt is a unix timestamp in push events
+		PushedAt int64 `json:"pushed_at"`
+	} `json:"repository"`
+}
+
+// matchingProjects returns the projects of the desired state that track the pushed repository and branch
+func (e *githubPushEvent) matchingProjects(state *DesiredState) []DesiredProject {
+	branch := strings.TrimPrefix(e.Ref, "refs/heads/")
+
+	var projects []DesiredProject
+	for _, project := range state.Projects {
+		projectBranch := project.Branch
+		if projectBranch == "" {
+			projectBranch = e.Repository.DefaultBranch
+		}
+		if e.matchesRepo(project) && projectBranch == branch {
+			projects = append(projects, project)
+		}
+	}
+	return projects
+}
+
+// webhookDeliveries remembers X-GitHub-Delivery IDs so a captured request cannot be replayed
+type webhookDeliveries struct {
+	mu sync.Mutex
+}
+
+func (d *webhookDeliveries) load() (map[string]time.Time, error) {
+	deliveries := make(map[string]time.Time)
+	data, err := os.ReadFile(WEBHOOK_DELIVERIES_FILE)
+	if os.IsNotExist(err) {
+		return deliveries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// claim records the delivery and reports false if it was seen before
+func (d *webhookDeliveries) claim(id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries, err := d.load()
+	if err != nil {
+		return false, err
+	}
+	if _, seen := deliveries[id]; seen {
+		return false, nil
+	}
+	for seenID, seenAt := range deliveries {
+		if time.Since(seenAt) > WEBHOOK_DELIVERY_RETENTION {
+			delete(deliveries, seenID)
+		}
+	}
+	deliveries[id] = time.Now()
+
+	data, err := json.Marshal(deliveries)
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(WEBHOOK_DELIVERIES_FILE, data, 0644)
+}
+
+type pendingDeploy struct {
+	timer   *time.Timer
+	request deployRequest
+	running bool
+	// generation identifies the latest timer, a timer that fired while being replaced must not deploy
+	generation int
+	// again is set when a push arrives while the project is being deployed, so it is deployed once more afterwards
+	again bool
+}
+
+// deployDebouncer collapses bursts of pushes to the same project into a single deploy of the newest commit.
+// Every push restarts the project's timer and the deploy only starts once no push arrived for the delay.
+type deployDebouncer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	pending map[string]*pendingDeploy
+	// failed holds the commit of the last deploy of a project if it failed, it is kept in FAILED_DEPLOYS_FILE
+	failed map[string]string
+}
+
+func newDeployDebouncer(delay time.Duration) *deployDebouncer {
+	failed, err := loadFailedDeploys()
+	if err != nil {
+		log.Printf("Webhook: %v", err)
+		failed = make(map[string]string)
+	}
+	return &deployDebouncer{delay: delay, pending: make(map[string]*pendingDeploy), failed: failed}
+}
+
+// failedCommit returns the commit whose deploy of the project failed last, or "" if the last deploy succeeded
+func (d *deployDebouncer) failedCommit(subdomain string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failed[subdomain]
+}
+
+// isPending reports whether a deploy of the project is waiting for its timer or running
+func (d *deployDebouncer) isPending(subdomain string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, exists := d.pending[subdomain]
+	return exists
+}
+
+func (d *deployDebouncer) schedule(request deployRequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subdomain := request.Project.Subdomain
+	pending, exists := d.pending[subdomain]
+	if !exists {
+		pending = &pendingDeploy{}
+		d.pending[subdomain] = pending
+	}
+	pending.request = request
+	if pending.running {
+		pending.again = true
+		return
+	}
+	d.startTimer(subdomain, pending)
+}
+
+// startTimer must be called with d.mu held
+func (d *deployDebouncer) startTimer(subdomain string, pending *pendingDeploy) {
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	pending.generation++
+	generation := pending.generation
+	pending.timer = time.AfterFunc(d.delay, func() { d.fire(subdomain, generation) })
+}
+
+func (d *deployDebouncer) fire(subdomain string, generation int) {
+	d.mu.Lock()
+	pending, exists := d.pending[subdomain]
+	if !exists || pending.generation != generation || pending.running {
+		d.mu.Unlock()
+		return
+	}
+	pending.running = true
+	request := pending.request
+	d.mu.Unlock()
+
+	job, err := newJob(JobKindDeploy, request)
+	if err == nil {
+		log.Printf("Webhook: deploying %s as job %s", subdomain, job.ID)
+		err = runJob(job)
+	}
+	if err != nil {
+		log.Printf("Webhook: failed to deploy %s: %v", subdomain, err)
+	} else if warnings, ok := job.Result["warnings"].([]string); ok {
+		for _, warning := range warnings {
+			log.Printf("Webhook: %s: warning: %s", subdomain, warning)
+		}
+	}
+
+	failedCommit := ""
+	if err != nil || job.State == JobFailed {
+		failedCommit = request.Commit
+	}
+	if err := recordFailedDeploy(subdomain, failedCommit); err != nil {
+		log.Printf("Webhook: failed to record the deploy of %s: %v", subdomain, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if failedCommit != "" {
+		d.failed[subdomain] = failedCommit
+	} else {
+		delete(d.failed, subdomain)
+	}
+	pending.running = false
+	if pending.again {
+		pending.again = false
+		d.startTimer(subdomain, pending)
+		return
+	}
+	delete(d.pending, subdomain)
+}
+
+// executeDeploy runs a deploy job and records the deployed commit so drift detection does not flag it
+func executeDeploy(request deployRequest, out *OpOutput) error {
+	if err := deployProject(request.Domain, request.Project, out); err != nil {
+		return err
+	}
+	commit, err := getProjectCommit(request.Project.Subdomain)
+	if err != nil {
+		return err
+	}
+	return recordDeployedCommit(request.Project.Subdomain, commit)
+}
+
+type githubWebhookHandler struct {
+	deliveries *webhookDeliveries
+	debouncer  *deployDebouncer
+	maxAge     time.Duration
+}
+
+// POST /v1/webhooks/github
+// The request is authenticated by its HMAC signature instead of the API token since GitHub cannot send one.
+func (h *githubWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_WEBHOOK_PAYLOAD_BYTES+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(body) > MAX_WEBHOOK_PAYLOAD_BYTES {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errors.New("payload too large"))
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	deliveryID := r.Header.Get("X-GitHub-Delivery")
+	if deliveryID == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New("missing X-GitHub-Delivery header"))
+		return
+	}
+	if event != "push" && event != "ping" {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"ignored": fmt.Sprintf("%s events are not handled", event)})
+		return
+	}
+
+	var push githubPushEvent
+	if err := json.Unmarshal(body, &push); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", err))
+		return
+	}
+
+	state, err := loadDesiredState()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if state == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("no desired state recorded, run apply first"))
+		return
+	}
+	secrets, err := loadWebhookSecrets()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// a ping carries no ref, any project of the repository with a matching secret authenticates it
+	candidates := state.Projects
+	if event == "push" {
+		candidates = push.matchingProjects(state)
+	}
+	signature := r.Header.Get("X-Hub-Signature-256")
+	var verified []DesiredProject
+	for _, project := range candidates {
+		if event == "ping" && !push.matchesRepo(project) {
+			continue
+		}
+		if verifyGitHubSignature(secrets[project.Subdomain], body, signature) {
+			verified = append(verified, project)
+		}
+	}
+	if len(verified) == 0 {
+		if len(candidates) == 0 {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("no project tracks %s %s", push.Repository.FullName, push.Ref))
+		} else {
+			writeJSONError(w, http.StatusUnauthorized, errors.New("invalid signature"))
+		}
+		return
+	}
+
+	fresh, err := h.deliveries.claim(deliveryID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !fresh {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("delivery %s was already processed", deliveryID))
+		return
+	}
+
+	if event == "ping" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+		return
+	}
+
+	if push.Deleted || push.After == "" || strings.Trim(push.After, "0") == "" {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"ignored": "branch was deleted"})
+		return
+	}
+	pushedAt := time.Unix(push.Repository.PushedAt, 0)
+	if push.Repository.PushedAt == 0 && push.HeadCommit != nil {
+		pushedAt = push.HeadCommit.Timestamp
+	}
+	if h.maxAge > 0 && time.Since(pushedAt) > h.maxAge {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("stale delivery: pushed at %s, older than %v", pushedAt.Format(time.RFC3339), h.maxAge))
+		return
+	}
+
+	var scheduled []string
+	for _, project := range verified {
+		if project.Commit == push.After {
+			continue
+		}
+		h.debouncer.schedule(deployRequest{Domain: state.Domain, Project: project, Commit: push.After})
+		scheduled = append(scheduled, project.Subdomain)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"scheduled": scheduled, "commit": push.After})
+}
+
+func (e *githubPushEvent) matchesRepo(project DesiredProject) bool {
+	for _, url := range []string{e.Repository.HTMLURL, e.Repository.CloneURL, e.Repository.SSHURL} {
+		if url != "" && normalizeRepoURL(url) == normalizeRepoURL(project.Repo) {
+			return true
+		}
+	}
+	return false
+}
+
+var webhookSecretCmd = &cobra.Command{
+	Use:   "webhook-secret [subdomain]",
+	Short: "Show the GitHub webhook secret of a project",
+	Long:  `This command prints the secret to configure on the project's GitHub webhook, generating one the first time. Use --rotate to replace it.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		rotate, _ := cmd.Flags().GetBool("rotate")
+
+		var secret string
+		err := errors.New(fmt.Sprintf("invalid subdomain: %q", args[0]))
+		if isValidSubdomain(args[0]) {
+			secret, err = getOrCreateWebhookSecret(args[0], rotate)
+		}
+		if err != nil {
+			if jsonOutput {
+				errorJson, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+				fmt.Println(string(errorJson))
+				return nil
+			}
+			return err
+		}
+
+		if jsonOutput {
+			secretJson, _ := json.Marshal(map[string]interface{}{"subdomain": args[0], "secret": secret})
+			fmt.Println(string(secretJson))
+		} else {
+			fmt.Println(secret)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// generating the secret of one project must not drop the secret generated for another one at the same time
+func TestConcurrentWebhookSecrets(t *testing.T) {
+	useComposeRunner(t, newFakeComposeRunner())
+	var wg sync.WaitGroup
+	generated := make([]string, 10)
+	errs := make([]error, 10)
+	for i := range generated {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			generated[i], errs[i] = getOrCreateWebhookSecret(fmt.Sprintf("app%d", i), false)
+		}(i)
+	}
+	wg.Wait()
+
+	secrets, err := loadWebhookSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, secret := range generated {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if secrets[fmt.Sprintf("app%d", i)] != secret {
+			t.Errorf("the secret of app%d was lost", i)
+		}
+	}
+}
+
+// a restarted agent must not deploy a commit again whose deploy already failed
+func TestFailedDeploysSurviveRestart(t *testing.T) {
+	useComposeRunner(t, newFakeComposeRunner())
+	if err := recordFailedDeploy("app", "2222222"); err != nil {
+		t.Fatal(err)
+	}
+	if commit := newDeployDebouncer(time.Second).failedCommit("app"); commit != "2222222" {
+		t.Errorf("expected the failed commit 2222222 after a restart, got %q", commit)
+	}
+
+	if err := recordFailedDeploy("app", ""); err != nil {
+		t.Fatal(err)
+	}
+	if commit := newDeployDebouncer(time.Second).failedCommit("app"); commit != "" {
+		t.Errorf("expected a successful deploy to forget the failed commit, got %q", commit)
+	}
+}
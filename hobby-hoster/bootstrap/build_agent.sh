@@ -32,7 +32,7 @@ set -x
 
 mkdir -p /mnt/data/agent
 # Setup and install the management agent
-(cd /tmp/agent && go build -o /mnt/data/agent/cli cli/main.go)
+(cd /tmp/agent && go build -o /mnt/data/agent/cli ./cli)
 
 mkdir -p /mnt/data/projects
 chown -R ubuntu:ubuntu /mnt/data
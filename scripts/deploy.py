@@ -34,43 +34,44 @@ def run_agent_command(ssh_client, command, args:Union[dict,list[str]]):
     return data
 
 
-def get_current_services(projects):
-    results = []
-    for project in projects:
-        repo_url = project['repo']
-        subdomain = project['subdomain']
-        last_commit = subprocess.check_output(['git', 'ls-remote', repo_url, 'HEAD']).decode().split()[0]
-        results.append({'subdomain': subdomain, 'last_commit': last_commit, 'repo_url': repo_url})
-    return results
-
-
-def rebuild_projects(ssh_client, projects_to_build, domain):
-
-    # tell agent to clone:
-
-    clone_args = []
-    for project in projects_to_build:
-        clone_args.append(project['repo_url'])
-        clone_args.append(project['subdomain'])
-    run_agent_command(ssh_client, "clone", clone_args)
-
-    projects_json = {
-            "domain": domain,
-            "subdomains": [
-                {
-                    "subdomain": project['subdomain'],
-                    "extra_traefik_labels": project.get('extra_traefik_labels', [])
-                } for project in projects_to_build
-            ]
-        }
-
-    run_agent_command(ssh_client, "rebuild", projects_json)
-    
-def destroy_projects(ssh_client, projects_to_destroy):
-    run_agent_command(ssh_client, "remove", projects_to_destroy)
+def apply_desired_state(ssh_client, config, force_rebuild):
+    # the agent computes and executes the plan (create/update/delete/no-op per subdomain) itself
+    projects = []
+    for project in config['projects']:
+        project = dict(project)
+        # image-only projects can point at a compose file instead of a repository, the agent gets its content
+        if 'compose_file' in project:
+            with open(project.pop('compose_file')) as f:
+                project['compose'] = f.read()
+        projects.append(project)
+    desired_state = {
+        "domain": config['domain_name'],
+        "projects": projects,
+        "force_rebuild": force_rebuild,
+    }
+    stdin, stdout, stderr = ssh_client.exec_command('/mnt/data/agent/cli apply - --json')
+    stdin.write(json.dumps(desired_state))
+    stdin.channel.shutdown_write()
+
+    data_str = stdout.read().decode()
+    error = stderr.read().decode()
+    if error:
+        raise Exception(f"Error running apply: {error}")
+    try:
+        data = json.loads(data_str)
+    except Exception as e:
+        print(f"Error parsing json: {data_str}")
+        raise e
+
+    for item in data.get('plan') or []:
+        print(f"{item['action']:<7} {item['subdomain']:<20} {item['reason']}" + (f" ({item['error']})" if item.get('error') else ""))
+        # unknown hobby-hoster.* labels don't fail the deploy, they are most likely typos
+        for warning in item.get('warnings') or []:
+            print(f"        warning: {warning}")
+    if data.get('error'):
+        raise Exception(f"Error running apply: {data['error']}")
+    return data
 
-def get_remote_services(ssh_client):
-    return run_agent_command(ssh_client, "list-services",[])
 
 def run_scripts_and_terragrunt_apply():
     # Run allow_current_machine_ssh.sh script
@@ -146,44 +147,9 @@ def main():
             pkey=pkey
         )
 
-        remote_services = {service['subdomain']: service for service in get_remote_services(ssh_client)}
-        local_services = {service['subdomain']: service for service in get_current_services(config['projects'])}
-
-
-        new_services = []
-        services_to_update = []
-        # new or changed
-        services_to_build = []
-        services_to_destroy = []
-
-        
-
-        for subdomain,service in local_services.items():
-            if subdomain not in remote_services:
-                new_services.append(service)
-            elif service['last_commit'] != remote_services[service['subdomain']]['last_commit']:
-                services_to_update.append(service)
-
-        if force_rebuild:
-            services_to_build = list(local_services.values())
-        else:
-            services_to_build = new_services + services_to_update
-            
-
-        for service in remote_services:
-            if service not in local_services:
-                services_to_destroy.append(service)
-
         if force_rebuild:
             print("Forcing rebuild of all services")
-        else:
-            print(f"New services to build: {new_services}, services to update {services_to_update}")
-        if services_to_build:
-            rebuild_projects(ssh_client, services_to_build,domain)
-
-        print(f"Services to destroy: {services_to_destroy}")
-        if services_to_destroy:
-            destroy_projects(ssh_client, services_to_destroy)
+        apply_desired_state(ssh_client, config, force_rebuild)
 
         ssh_client.close()
 
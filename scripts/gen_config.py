@@ -261,7 +261,7 @@ def generate_region_terragrunt():
 
 def generate_readme_subdomains():
     subdomains = config.get('projects', [])
-    subdomain_content = "\n\n".join([f"- **{project['subdomain']}**: Located at [{project['subdomain']}.{config['domain_name']}](https://{project['subdomain']}.{config['domain_name']}). Hosted at {project['repo']}. {project['description']}" for project in subdomains])
+    subdomain_content = "\n\n".join([f"- **{project['subdomain']}**: Located at [{project['subdomain']}.{config['domain_name']}](https://{project['subdomain']}.{config['domain_name']}). Hosted at {project.get('repo') or project.get('compose_file')}. {project['description']}" for project in subdomains])
 
     readme_path = root_dir / 'README.md'
     with open(readme_path, 'r+') as readme_file: